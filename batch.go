@@ -0,0 +1,146 @@
+package main
+
+import "slices"
+
+// GetMany finds the items stored under keys in a single walk over the tree
+// of c: the keys are visited in sorted order and a node on the path to
+// several of them is read once. The items are returned in the order of keys,
+// with nil for the keys that aren't there.
+func (c *Collection) GetMany(keys [][]byte) ([]*Item, error) {
+	items := make([]*Item, len(keys))
+	if c.root == 0 || len(keys) == 0 {
+		return items, nil
+	}
+
+	root, err := c.tx.readNode(c.root)
+	if err != nil {
+		return nil, err
+	}
+	order := c.sortedOrder(len(keys), func(i int) []byte { return keys[i] })
+	if err := c.getMany(root, keys, order, items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// getMany looks up the keys of order, which all belong under node, and
+// descends once into every child that holds some of them.
+func (c *Collection) getMany(node *Node, keys [][]byte, order []int, items []*Item) error {
+	for start := 0; start < len(order); {
+		found, index := node.findKeyInNode(keys[order[start]], c.compare)
+		if found {
+			if item := node.items[index]; !item.isCollection() {
+				items[order[start]] = c.visible(item)
+			}
+			start++
+			continue
+		}
+		if node.isLeaf() {
+			start++
+			continue
+		}
+
+		end := start + 1
+		for end < len(order) && (index == len(node.items) || c.compare(keys[order[end]], node.items[index].key) < 0) {
+			end++
+		}
+		child, err := c.tx.readNode(node.childNodes[index])
+		if err != nil {
+			return err
+		}
+		if err := c.getMany(child, keys, order[start:end], items); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// PutMany writes items like Put in key order. Consecutive keys that land in
+// the same leaf are inserted without descending the tree again, until a
+// split changes its shape. The error of every item is returned at its index;
+// the second result is only set when the batch can't run at all.
+func (c *Collection) PutMany(items []*Item) ([]error, error) {
+	if !c.tx.write {
+		return nil, writeInsideReadTxErr
+	}
+
+	errs := make([]error, len(items))
+	order := c.sortedOrder(len(items), func(i int) []byte { return items[i].key })
+
+	// leaf is the leaf the last item went to, while it still holds every
+	// key below upper. A nil upper bounds nothing.
+	var leaf *Node
+	var ancestors []int
+	var upper []byte
+	for _, i := range order {
+		key := items[i].key
+
+		var pos *position
+		if leaf != nil && (upper == nil || c.compare(key, upper) < 0) {
+			found, index := leaf.findKeyInNode(key, c.compare)
+			pos = &position{leaf, index, ancestors, found}
+		} else {
+			var err error
+			if pos, err = c.locate(key); err != nil {
+				errs[i] = err
+				leaf = nil
+				continue
+			}
+		}
+
+		var size int
+		if pos.node != nil {
+			size = len(pos.node.items)
+		}
+		_, errs[i] = c.updateAt(pos, func(*Item) (*Item, error) {
+			return c.newItem(key, items[i].value), nil
+		})
+		if errs[i] == nil && !pos.found {
+			size++
+		}
+
+		switch {
+		case pos.node == nil || !pos.node.isLeaf() || len(pos.node.items) != size:
+			// The item went to an internal node or its leaf was split.
+			leaf = nil
+		case pos.node != leaf:
+			var err error
+			if upper, err = c.upperBound(pos.ancestors); err != nil {
+				leaf = nil
+				continue
+			}
+			leaf, ancestors = pos.node, pos.ancestors
+		}
+	}
+	return errs, nil
+}
+
+// upperBound returns the smallest separator above the node reached through
+// ancestors, which every key in that node is less than, or nil if there is
+// none.
+func (c *Collection) upperBound(ancestors []int) ([]byte, error) {
+	nodes, err := c.getNodes(ancestors)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(nodes) - 2; i >= 0; i-- {
+		if index := ancestors[i+1]; index < len(nodes[i].items) {
+			return nodes[i].items[index].key, nil
+		}
+	}
+	return nil, nil
+}
+
+// sortedOrder returns the indexes 0 to n-1 ordered by the key of each with
+// the comparator of c. Equal keys keep their order.
+func (c *Collection) sortedOrder(n int, key func(i int) []byte) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		return c.compare(key(a), key(b))
+	})
+	return order
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestPutManyAndGetMany(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), &CollectionOptions{MaxItems: 2000})
+		if err != nil {
+			return err
+		}
+		if _, err := c.CreateCollection([]byte("child"), nil); err != nil {
+			return err
+		}
+
+		// Keys in random order, one of them twice and one over the quota.
+		var items []*Item
+		for _, i := range rand.New(rand.NewSource(1)).Perm(2000) {
+			items = append(items, NewItem(benchKey(i), []byte(fmt.Sprint(i))))
+		}
+		items = append(items, NewItem(benchKey(7), []byte("last")), NewItem(benchKey(5000), []byte("over")))
+		errs, err := c.PutMany(items)
+		if err != nil {
+			return err
+		}
+		for i, err := range errs[:2001] {
+			if err != nil {
+				t.Errorf("item %d failed with %v", i, err)
+			}
+		}
+		if errs[2001] != ErrQuotaExceeded {
+			t.Errorf("the item over the quota failed with %v, want %v", errs[2001], ErrQuotaExceeded)
+		}
+		if n := len(collectionKeys(t, c)); n != 2001 {
+			t.Errorf("c holds %d keys, want 2000 and child", n)
+		}
+
+		found, err := c.GetMany([][]byte{benchKey(1999), []byte("missing"), benchKey(7), []byte("child"), benchKey(0)})
+		if err != nil {
+			return err
+		}
+		var got []string
+		for _, item := range found {
+			if item == nil {
+				got = append(got, "nil")
+				continue
+			}
+			got = append(got, string(item.Value()))
+		}
+		if fmt.Sprint(got) != "[1999 nil last nil 0]" {
+			t.Errorf("GetMany returned %v, want [1999 nil last nil 0]", got)
+		}
+		return nil
+	})
+
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		if _, err := c.PutMany([]*Item{NewItem([]byte("k"), nil)}); err != writeInsideReadTxErr {
+			t.Errorf("PutMany in a read transaction returned %v", err)
+		}
+		return nil
+	})
+}
+
+func TestPutManySmallPages(t *testing.T) {
+	db := openSmallPagesDB(t)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), nil)
+		if err != nil {
+			return err
+		}
+		var items []*Item
+		for _, i := range rand.New(rand.NewSource(2)).Perm(1000) {
+			items = append(items, NewItem([]byte(fmt.Sprintf("k%04d", i)), make([]byte, i%60)))
+		}
+		errs, err := c.PutMany(items)
+		if err != nil {
+			return err
+		}
+		for i, err := range errs {
+			if err != nil {
+				t.Fatalf("item %d failed with %v", i, err)
+			}
+		}
+		if n := len(checkTree(t, tx, c.root)); n != 1000 {
+			t.Errorf("the tree holds %d keys, want 1000", n)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// A blob is stored outside of the tree, in pages of its own. Its item holds
+// the size of the blob and the first of the index pages listing the chunk
+// pages; each index page starts with the number of the next one, 0 at the
+// end. The chunk pages hold the data as is, every one of them full but the
+// last.
+const blobHeaderSize = 8 + pageNumberSize
+
+var (
+	valueNotFoundErr = errors.New("key not found")
+	blobHistoryErr   = errors.New("a collection with history can't store blobs")
+	invalidSeekErr   = errors.New("invalid seek position")
+)
+
+// PutReader stores size bytes read from r under key as a blob, a chunk at a
+// time instead of as one value. Blobs are read back with OpenReader; Find
+// and cursors see them with an empty value, and indexes skip them.
+func (c *Collection) PutReader(key []byte, r io.Reader, size int64) error {
+	if !c.tx.write {
+		return writeInsideReadTxErr
+	}
+	if c.meta.History {
+		return blobHistoryErr
+	}
+
+	header, pages, err := c.tx.writeBlob(r, size)
+	if err == nil {
+		item := &Item{key: key, value: header, flags: blobItemFlag}
+		if c.meta.TTL > 0 {
+			item = expiringItem(key, header, c.meta.TTL)
+			item.flags |= blobItemFlag
+		}
+		err = c.put(item)
+	}
+	if err != nil {
+		c.tx.freePages(pages)
+	}
+	return err
+}
+
+// OpenReader returns a reader over the value stored under key, which can be
+// a blob or any other value. It is only valid until the transaction ends.
+func (c *Collection) OpenReader(key []byte) (io.ReadSeekCloser, error) {
+	item, err := c.find(key)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil || item.isCollection() || c.visible(item) == nil {
+		return nil, valueNotFoundErr
+	}
+	if !item.isBlob() {
+		return &valueReader{*bytes.NewReader(item.plainValue()), c.tx}, nil
+	}
+
+	size, chunks, _, err := c.tx.readBlob(item.plainValue())
+	if err != nil {
+		return nil, err
+	}
+	return &blobReader{c.tx, size, chunks, 0, nil, false}, nil
+}
+
+// writeBlob writes size bytes from r to new pages and returns the header of
+// the blob along with every page it took, so they can be freed if the blob
+// isn't stored after all.
+func (tx *Tx) writeBlob(r io.Reader, size int64) ([]byte, []pageNumber, error) {
+	var pages, chunks []pageNumber
+	for written := int64(0); written < size; {
+		p := tx.db.allocateEmptyPage()
+		n := int(min(size-written, int64(tx.db.pageSize)))
+		if _, err := io.ReadFull(r, p.data[:n]); err != nil {
+			return nil, pages, err
+		}
+		p.number = tx.allocatePage()
+		pages = append(pages, p.number)
+		if err := tx.db.writePage(p); err != nil {
+			return nil, pages, err
+		}
+		chunks = append(chunks, p.number)
+		written += int64(n)
+	}
+
+	// The index pages are written last to first, so each knows the next.
+	perPage := (tx.db.pageSize - pageNumberSize) / pageNumberSize
+	var next pageNumber
+	for start := (len(chunks) - 1) / perPage * perPage; start >= 0 && len(chunks) != 0; start -= perPage {
+		p := tx.db.allocateEmptyPage()
+		binary.LittleEndian.PutUint64(p.data, uint64(next))
+		for i, chunk := range chunks[start:min(start+perPage, len(chunks))] {
+			binary.LittleEndian.PutUint64(p.data[pageNumberSize*(i+1):], uint64(chunk))
+		}
+		p.number = tx.allocatePage()
+		pages = append(pages, p.number)
+		if err := tx.db.writePage(p); err != nil {
+			return nil, pages, err
+		}
+		next = p.number
+	}
+
+	header := binary.LittleEndian.AppendUint64(nil, uint64(size))
+	return binary.LittleEndian.AppendUint64(header, uint64(next)), pages, nil
+}
+
+// readBlob returns the size of the blob with the given header, its chunk
+// pages and its index pages.
+func (tx *Tx) readBlob(header []byte) (int64, []pageNumber, []pageNumber, error) {
+	size := int64(binary.LittleEndian.Uint64(header))
+	count := int((size + int64(tx.db.pageSize) - 1) / int64(tx.db.pageSize))
+
+	var chunks, indexPages []pageNumber
+	for number := pageNumber(binary.LittleEndian.Uint64(header[8:])); number != 0; {
+		p, err := tx.db.readPage(number)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		indexPages = append(indexPages, number)
+		for pos := pageNumberSize; pos+pageNumberSize <= len(p.data) && len(chunks) < count; pos += pageNumberSize {
+			chunks = append(chunks, pageNumber(binary.LittleEndian.Uint64(p.data[pos:])))
+		}
+		number = pageNumber(binary.LittleEndian.Uint64(p.data))
+	}
+	return size, chunks, indexPages, nil
+}
+
+// releaseBlob frees the pages of the blob item holds.
+func (tx *Tx) releaseBlob(item *Item) error {
+	_, chunks, indexPages, err := tx.readBlob(item.plainValue())
+	if err != nil {
+		return err
+	}
+	tx.freePages(chunks)
+	tx.freePages(indexPages)
+	return nil
+}
+
+func (tx *Tx) allocatePage() pageNumber {
+	number := tx.db.getNextPage()
+	tx.allocatedPages = append(tx.allocatedPages, number)
+	return number
+}
+
+// freePages hands pages back to the freelist once the transaction commits.
+func (tx *Tx) freePages(pages []pageNumber) {
+	tx.mutations++
+	tx.pagesToDelete = append(tx.pagesToDelete, pages...)
+}
+
+func (i *Item) isBlob() bool {
+	return i.flags&blobItemFlag != 0
+}
+
+func (i *Item) IsBlob() bool {
+	return i.isBlob()
+}
+
+// blobSize is the size of the blob item holds.
+func (i *Item) blobSize() uint64 {
+	return binary.LittleEndian.Uint64(i.plainValue())
+}
+
+// valueReader reads a value stored in the tree.
+type valueReader struct {
+	bytes.Reader
+	tx *Tx
+}
+
+func (r *valueReader) Read(p []byte) (int, error) {
+	if r.tx.closed {
+		return 0, itemOutlivedTxErr
+	}
+	return r.Reader.Read(p)
+}
+
+func (r *valueReader) Close() error {
+	return nil
+}
+
+// blobReader reads a blob a chunk page at a time, keeping the last page it
+// read.
+type blobReader struct {
+	tx     *Tx
+	size   int64
+	chunks []pageNumber
+	offset int64
+	page   *page
+	closed bool
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if r.tx.closed {
+		return 0, itemOutlivedTxErr
+	}
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	pageSize := int64(r.tx.db.pageSize)
+	chunk := r.chunks[r.offset/pageSize]
+	if r.page == nil || r.page.number != chunk {
+		page, err := r.tx.db.readPage(chunk)
+		if err != nil {
+			return 0, err
+		}
+		page.number = chunk
+		r.page = page
+	}
+
+	end := min(pageSize, r.size-r.offset/pageSize*pageSize)
+	n := copy(p, r.page.data[r.offset%pageSize:end])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, invalidSeekErr
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *blobReader) Close() error {
+	r.closed = true
+	r.page = nil
+	return nil
+}
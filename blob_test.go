@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestBlobs(t *testing.T) {
+	db := openTestDB(t, nil)
+	// Enough chunks for more than one index page, the last one not full.
+	blob := make([]byte, 600*db.pageSize+100)
+	rand.New(rand.NewSource(1)).Read(blob)
+
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), nil)
+		if err != nil {
+			return err
+		}
+		if err := c.PutReader([]byte("blob"), bytes.NewReader(blob), int64(len(blob))); err != nil {
+			return err
+		}
+		return c.Put([]byte("plain"), []byte("value"))
+	})
+
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		r, err := c.OpenReader([]byte("blob"))
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		got, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, blob) {
+			t.Errorf("read %d bytes of the blob back, not the %d written", len(got), len(blob))
+		}
+
+		for _, seek := range []struct {
+			offset int64
+			whence int
+			want   int64
+		}{
+			{int64(db.pageSize) - 10, io.SeekStart, int64(db.pageSize) - 10},
+			{-50, io.SeekEnd, int64(len(blob)) - 50},
+			{-int64(db.pageSize), io.SeekCurrent, int64(len(blob)) - 30 - int64(db.pageSize)},
+		} {
+			position, err := r.Seek(seek.offset, seek.whence)
+			if err != nil {
+				return err
+			}
+			if position != seek.want {
+				t.Errorf("Seek(%d, %d) moved to %d, want %d", seek.offset, seek.whence, position, seek.want)
+			}
+			// Reads go across chunk pages.
+			got := make([]byte, 20)
+			if _, err := io.ReadFull(r, got); err != nil {
+				return err
+			}
+			if !bytes.Equal(got, blob[seek.want:seek.want+20]) {
+				t.Errorf("read %x at %d, want %x", got, seek.want, blob[seek.want:seek.want+20])
+			}
+		}
+		if _, err := r.Seek(-1, io.SeekStart); err != invalidSeekErr {
+			t.Errorf("seeking before the start returned %v", err)
+		}
+
+		r, err = c.OpenReader([]byte("plain"))
+		if err != nil {
+			return err
+		}
+		if got, err := io.ReadAll(r); err != nil || string(got) != "value" {
+			t.Errorf("reading a plain value returned %q, %v", got, err)
+		}
+		if _, err := c.OpenReader([]byte("missing")); err != valueNotFoundErr {
+			t.Errorf("opening a missing key returned %v", err)
+		}
+		return nil
+	})
+}
+
+func TestBlobsWithHistory(t *testing.T) {
+	db := openTestDB(t, nil)
+	tx := db.WriteTx()
+	defer tx.Rollback()
+	c, err := tx.CreateCollection([]byte("c"), &CollectionOptions{History: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PutReader([]byte("blob"), bytes.NewReader([]byte("x")), 1); err != blobHistoryErr {
+		t.Errorf("PutReader with history returned %v", err)
+	}
+}
+
+func TestReplacedBlobsFreeTheirPages(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		_, err := tx.CreateCollection([]byte("c"), nil)
+		return err
+	})
+	empty := usedPages(db)
+
+	blob := bytes.Repeat([]byte("x"), 50*db.pageSize)
+	for _, replace := range []func(c *Collection) error{
+		func(c *Collection) error { return c.PutReader([]byte("blob"), bytes.NewReader(blob), 10) },
+		func(c *Collection) error { return c.Put([]byte("blob"), []byte("value")) },
+		func(c *Collection) error { return c.Remove([]byte("blob")) },
+	} {
+		update(t, db, func(tx *Tx) error {
+			c, err := tx.GetCollection([]byte("c"))
+			if err != nil {
+				return err
+			}
+			return c.PutReader([]byte("blob"), bytes.NewReader(blob), int64(len(blob)))
+		})
+		if used := usedPages(db); used < empty+50 {
+			t.Fatalf("the blob takes %d pages", used-empty)
+		}
+		update(t, db, func(tx *Tx) error {
+			c, err := tx.GetCollection([]byte("c"))
+			if err != nil {
+				return err
+			}
+			return replace(c)
+		})
+		if used := usedPages(db); used > empty+2 {
+			t.Errorf("%d pages are still used after replacing the blob", used-empty)
+		}
+	}
+}
+
+func TestBlobReaderLifetime(t *testing.T) {
+	db := openTestDB(t, nil)
+	blob := bytes.Repeat([]byte("x"), 3*db.pageSize)
+	var reader io.ReadSeekCloser
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), nil)
+		if err != nil {
+			return err
+		}
+		if err := c.PutReader([]byte("blob"), bytes.NewReader(blob), int64(len(blob))); err != nil {
+			return err
+		}
+		reader, err = c.OpenReader([]byte("blob"))
+		return err
+	})
+	if _, err := reader.Read(make([]byte, 10)); err != itemOutlivedTxErr {
+		t.Errorf("reading after the transaction returned %v", err)
+	}
+
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		r, err := c.OpenReader([]byte("blob"))
+		if err != nil {
+			return err
+		}
+		r.Close()
+		if _, err := r.Read(make([]byte, 10)); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("reading a closed reader returned %v", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"iter"
+	"slices"
+)
+
+var (
+	unsortedInputErr  = errors.New("bulk load input is not in increasing key order")
+	bulkLoadTargetErr = errors.New("bulk loading needs an empty collection without indexes or history")
+)
+
+// BulkLoad fills the top-level collection name, creating it if needed, with
+// items, which have to come in increasing key order without duplicates.
+// Rather than putting them one at a time, it packs them into leaves up to
+// Options.BulkFillPercent, builds the internal levels from the bottom up and
+// writes every node once, to pages appended to the file in order. The tree
+// is installed by a single transaction: on any error, unsorted input
+// included, the collection is left as it was.
+func (db *DB) BulkLoad(name []byte, items iter.Seq2[[]byte, []byte]) error {
+	tx := db.WriteTx()
+	if err := tx.bulkLoad(name, items); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (tx *Tx) bulkLoad(name []byte, items iter.Seq2[[]byte, []byte]) error {
+	c, err := tx.CreateCollectionIfNotExists(name, nil)
+	if err != nil {
+		return err
+	}
+	var root *Node
+	if c.root != 0 {
+		if root, err = tx.getNode(c.root); err != nil {
+			return err
+		}
+	}
+	if root != nil && len(root.items) != 0 || len(c.indexes) != 0 || c.meta.History {
+		return bulkLoadTargetErr
+	}
+	if err := c.loadUsage(); err != nil {
+		return err
+	}
+
+	loader := &bulkLoader{tx: tx, limit: int(tx.db.bulkThreshold())}
+
+	var last []byte
+	for key, value := range items {
+		if last != nil && c.compare(last, key) >= 0 {
+			return unsortedInputErr
+		}
+		if c.isReservedName(key) {
+			return reservedNameErr
+		}
+		item := c.newItem(bytes.Clone(key), bytes.Clone(value))
+		if err := c.checkQuota(nil, item); err != nil {
+			return err
+		}
+		if err := loader.add(item); err != nil {
+			return err
+		}
+		c.track(nil, item)
+		if err := c.updateExpiry(nil, item); err != nil {
+			return err
+		}
+		last = item.key
+	}
+
+	newRoot, err := loader.finish()
+	if err != nil || newRoot == 0 {
+		return err
+	}
+	if root != nil {
+		tx.deleteNode(root)
+	}
+	c.setRoot(newRoot)
+	return nil
+}
+
+// bulkLoader builds a tree out of items added in key order. levels holds
+// the node being filled on every level, leaves first, and sizes their
+// serialized sizes. Nodes are filled up to limit, short of the maximum, so
+// that the first writes into them don't split them.
+//
+// When an item comes to a node past limit, the last item of the node moves
+// up as the separator and the item starts the next node, along with the
+// last child for an internal node. Every node being filled thus holds an
+// item. The full node is held back in held, its page in pages, until the
+// next one on its level is full, so the last two on each level can be
+// balanced at the end.
+type bulkLoader struct {
+	tx     *Tx
+	limit  int
+	levels []*Node
+	sizes  []int
+	held   []*Node
+	pages  []pageNumber
+}
+
+func (b *bulkLoader) add(item *Item) error {
+	if itemSize(item) > b.tx.db.maxItemSize() {
+		return itemTooLargeErr
+	}
+	return b.push(0, item, 0)
+}
+
+// push adds item to the node being filled on level, preceded by child, the
+// node on the level below that holds the keys before item, for internal
+// levels.
+func (b *bulkLoader) push(level int, item *Item, child pageNumber) error {
+	if level == len(b.levels) {
+		b.levels = append(b.levels, NewNodeForSerialization([]*Item{}, []pageNumber{}))
+		b.sizes = append(b.sizes, nodeHeaderSize+pageNumberSize)
+		b.held = append(b.held, nil)
+		b.pages = append(b.pages, 0)
+	}
+	node := b.levels[level]
+
+	// A node takes items while it is within limit, as its last moves up
+	// when it's full. A full node thus keeps at least one.
+	if len(node.items) < 2 || b.sizes[level] <= b.limit {
+		if level > 0 {
+			node.childNodes = append(node.childNodes, child)
+		}
+		node.items = append(node.items, item)
+		b.sizes[level] += itemSize(item)
+		return nil
+	}
+
+	page, err := b.complete(level)
+	if err != nil {
+		return err
+	}
+	next := NewNodeForSerialization([]*Item{item}, []pageNumber{})
+	if level > 0 {
+		next.childNodes = append(next.childNodes, child)
+	}
+	b.levels[level] = next
+	b.sizes[level] = nodeHeaderSize + pageNumberSize + itemSize(item)
+	return b.push(level+1, node.items[len(node.items)-1], page)
+}
+
+// complete holds back the full node on level, without its last item, in
+// place of the one held before, which is written.
+func (b *bulkLoader) complete(level int) (pageNumber, error) {
+	if b.held[level] != nil {
+		if err := b.write(b.held[level], b.pages[level]); err != nil {
+			return 0, err
+		}
+	}
+	node := b.levels[level]
+	last := len(node.items) - 1
+	held := NewNodeForSerialization(node.items[:last], []pageNumber{})
+	if level > 0 {
+		held.childNodes = node.childNodes[:last+1]
+	}
+	b.held[level], b.pages[level] = held, b.allocate()
+	return b.pages[level], nil
+}
+
+// finish writes the nodes still being filled, balanced with the ones held
+// before them, giving each internal one the node below as its last child,
+// and returns the root, or 0 if nothing was added.
+func (b *bulkLoader) finish() (pageNumber, error) {
+	var child pageNumber
+	for level := 0; level < len(b.levels); level++ {
+		node := b.levels[level]
+		if level > 0 {
+			node.childNodes = append(node.childNodes, child)
+		}
+		if !b.fits(node.nodeSize()) {
+			// Its last item took it past the maximum, so it's completed
+			// like the full ones, leaving an empty node to balance with.
+			page, err := b.complete(level)
+			if err != nil {
+				return 0, err
+			}
+			if err := b.push(level+1, node.items[len(node.items)-1], page); err != nil {
+				return 0, err
+			}
+			node = NewNodeForSerialization([]*Item{}, []pageNumber{})
+			if level > 0 {
+				node.childNodes = append(node.childNodes, child)
+			}
+		}
+		var err error
+		switch {
+		case b.held[level] != nil:
+			child, err = b.balance(level, node)
+		case len(node.items) == 0:
+			// Merging the last two nodes below took the only item of the
+			// root, which leaves its one child as the root.
+			child = node.childNodes[0]
+		default:
+			child = b.allocate()
+			err = b.write(node, child)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return child, nil
+}
+
+// balance writes node, the last on level, and the full node held before it.
+// The two are merged if they fit in one node, which leaves a single child
+// to the parent; otherwise their items are split again between them, so the
+// last isn't left with a handful. It returns the page of the last node.
+func (b *bulkLoader) balance(level int, node *Node) (pageNumber, error) {
+	held, parent := b.held[level], b.levels[level+1]
+	last := len(parent.items) - 1
+	items := append(append(slices.Clone(held.items), parent.items[last]), node.items...)
+	children := append(slices.Clone(held.childNodes), node.childNodes...)
+
+	merged := NewNodeForSerialization(items, children)
+	if b.fits(merged.nodeSize()) {
+		parent.items = parent.items[:last]
+		parent.childNodes = parent.childNodes[:last]
+		return b.pages[level], b.write(merged, b.pages[level])
+	}
+
+	split := b.evenSplit(items)
+	held.items, node.items = items[:split], items[split+1:]
+	if len(children) != 0 {
+		held.childNodes, node.childNodes = children[:split+1], children[split+1:]
+	}
+	parent.items[last] = items[split]
+	if err := b.write(held, b.pages[level]); err != nil {
+		return 0, err
+	}
+	page := b.allocate()
+	return page, b.write(node, page)
+}
+
+// evenSplit returns the index of the item that splits items into two nodes,
+// neither of them empty or overpopulated: the one that fills both to the
+// minimum most evenly, or else the one that fills the first to it and
+// leaves the most to the last, or else the most even one.
+func (b *bulkLoader) evenSplit(items []*Item) int {
+	total := nodeHeaderSize + pageNumberSize
+	for _, item := range items {
+		total += itemSize(item)
+	}
+	split, rank, best := len(items)/2, -1, 0
+	left := nodeHeaderSize + pageNumberSize
+	for i := 1; i < len(items)-1; i++ {
+		left += itemSize(items[i-1])
+		right := total - left - itemSize(items[i]) + nodeHeaderSize + pageNumberSize
+		if !b.fits(left) || !b.fits(right) {
+			continue
+		}
+		r, size := 0, min(left, right)
+		switch {
+		case b.filled(left) && b.filled(right):
+			r = 2
+		case b.filled(left):
+			r, size = 1, right
+		}
+		if r > rank || r == rank && size > best {
+			split, rank, best = i, r, size
+		}
+	}
+	return split
+}
+
+// fits reports whether a node of size bytes isn't overpopulated.
+func (b *bulkLoader) fits(size int) bool {
+	return float32(size) <= b.tx.db.maxThreshold()
+}
+
+// filled reports whether a node of size bytes isn't underpopulated.
+func (b *bulkLoader) filled(size int) bool {
+	return float32(size) >= b.tx.db.minThreshold()
+}
+
+// allocate takes a page from the end of the file, so the nodes are written
+// in order.
+func (b *bulkLoader) allocate() pageNumber {
+	number := b.tx.db.appendPage()
+	b.tx.allocatedPages = append(b.tx.allocatedPages, number)
+	return number
+}
+
+func (b *bulkLoader) write(node *Node, number pageNumber) error {
+	p := b.tx.db.allocateEmptyPage()
+	p.number = number
+	node.serialize(p.data)
+	return b.tx.db.writePage(p)
+}
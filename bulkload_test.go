@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"iter"
+	"path/filepath"
+	"testing"
+)
+
+// sortedItems yields count keys in order, each with a value of a size that
+// varies with the key.
+func sortedItems(count int) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for i := range count {
+			if !yield(benchKey(i), bytes.Repeat([]byte("v"), i%40)) {
+				return
+			}
+		}
+	}
+}
+
+func items(pairs ...string) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for _, key := range pairs {
+			if !yield([]byte(key), []byte("value")) {
+				return
+			}
+		}
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	db := openSmallPagesDB(t)
+	if err := db.BulkLoad([]byte("c"), sortedItems(5000)); err != nil {
+		t.Fatal(err)
+	}
+
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		keys := checkFilledTree(t, tx, c.root)
+		if len(keys) != 5000 {
+			t.Fatalf("the tree holds %d keys, want 5000", len(keys))
+		}
+		for i, key := range keys {
+			if !bytes.Equal(key, benchKey(i)) {
+				t.Fatalf("key %d is %s", i, key)
+			}
+		}
+		for _, i := range []int{0, 1234, 4999} {
+			value, err := c.Get(benchKey(i))
+			if err != nil {
+				return err
+			}
+			if len(value) != i%40 {
+				t.Errorf("%s has a value of %d bytes, want %d", benchKey(i), len(value), i%40)
+			}
+		}
+		return nil
+	})
+
+	// The loaded tree takes writes like any other.
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 5000; i += 2 {
+			if err := c.Remove(benchKey(i)); err != nil {
+				return err
+			}
+		}
+		if err := c.Put([]byte("new"), []byte("value")); err != nil {
+			return err
+		}
+		if keys := checkTree(t, tx, c.root); len(keys) != 2501 {
+			t.Errorf("the tree holds %d keys after the writes, want 2501", len(keys))
+		}
+		return nil
+	})
+}
+
+func TestBulkLoadPacksLeaves(t *testing.T) {
+	loaded := openSmallPagesDB(t)
+	if err := loaded.BulkLoad([]byte("c"), sortedItems(5000)); err != nil {
+		t.Fatal(err)
+	}
+	put := openSmallPagesDB(t)
+	update(t, put, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), nil)
+		if err != nil {
+			return err
+		}
+		for key, value := range sortedItems(5000) {
+			if err := c.Put(key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if usedPages(loaded) >= usedPages(put) {
+		t.Errorf("the loaded tree takes %d pages, the one put %d", usedPages(loaded), usedPages(put))
+	}
+}
+
+// countNodes returns the number of nodes in the tree rooted at pageNum.
+func countNodes(tb testing.TB, tx *Tx, pageNum pageNumber) int {
+	tb.Helper()
+	node, err := tx.getNode(pageNum)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	count := 1
+	for _, child := range node.childNodes {
+		count += countNodes(tb, tx, child)
+	}
+	return count
+}
+
+func TestBulkLoadBalancesTheLastNodes(t *testing.T) {
+	// Every count up to a few leaves and a root that takes an item or two.
+	for count := 1; count <= 400; count++ {
+		db := openSmallPagesDB(t)
+		if err := db.BulkLoad([]byte("c"), sortedItems(count)); err != nil {
+			t.Fatal(err)
+		}
+		view(t, db, func(tx *Tx) error {
+			c, err := tx.GetCollection([]byte("c"))
+			if err != nil {
+				return err
+			}
+			if keys := checkFilledTree(t, tx, c.root); len(keys) != count {
+				t.Fatalf("loading %d items left %d keys", count, len(keys))
+			}
+			return nil
+		})
+	}
+}
+
+func TestBulkLoadLeavesRoom(t *testing.T) {
+	db := openTestDB(t, nil)
+	if err := db.BulkLoad([]byte("c"), sortedItems(5000)); err != nil {
+		t.Fatal(err)
+	}
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		// Items that take up all the room left under the maximum, each in
+		// another leaf, short of the last ones.
+		room := int(db.maxThreshold()) - int(db.bulkThreshold())
+		nodes := countNodes(t, tx, c.root)
+		for i := 100; i < 4600; i += 200 {
+			key := append(benchKey(i), 'x')
+			value := make([]byte, room-itemSize(NewItem(key, nil)))
+			if err := c.Put(key, value); err != nil {
+				return err
+			}
+		}
+		if after := countNodes(t, tx, c.root); after != nodes {
+			t.Errorf("the tree went from %d nodes to %d, the puts split loaded leaves", nodes, after)
+		}
+		return nil
+	})
+}
+
+func TestBulkLoadRejects(t *testing.T) {
+	db := openSmallPagesDB(t)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("full"), nil)
+		if err != nil {
+			return err
+		}
+		return c.Put([]byte("key"), []byte("value"))
+	})
+
+	for _, test := range []struct {
+		name       string
+		collection string
+		items      iter.Seq2[[]byte, []byte]
+		err        error
+	}{
+		{"unsorted", "c", items("a", "c", "b"), unsortedInputErr},
+		{"duplicate", "c", items("a", "b", "b"), unsortedInputErr},
+		{"too large", "c", func(yield func([]byte, []byte) bool) {
+			yield([]byte("a"), make([]byte, db.pageSize))
+		}, itemTooLargeErr},
+		{"not empty", "full", items("a"), bulkLoadTargetErr},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			used := usedPages(db)
+			if err := db.BulkLoad([]byte(test.collection), test.items); err != test.err {
+				t.Fatalf("BulkLoad returned %v, want %v", err, test.err)
+			}
+			if usedPages(db) != used {
+				t.Errorf("a failed load left %d pages used, not %d", usedPages(db), used)
+			}
+		})
+	}
+
+	view(t, db, func(tx *Tx) error {
+		if c, err := tx.GetCollection([]byte("c")); err != nil || c != nil {
+			t.Errorf("after failed loads GetCollection returned %v, %v", c, err)
+		}
+		c, err := tx.GetCollection([]byte("full"))
+		if err != nil {
+			return err
+		}
+		if keys := collectionKeys(t, c); fmt.Sprint(keys) != "[key]" {
+			t.Errorf("a failed load left %v", keys)
+		}
+		return nil
+	})
+}
+
+func TestBulkLoadSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDBAt(t, path, nil)
+	if err := db.BulkLoad([]byte("c"), sortedItems(20000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDBAt(t, path, nil)
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		if keys := checkFilledTree(t, tx, c.root); len(keys) != 20000 {
+			t.Errorf("the tree holds %d keys after reopening, want 20000", len(keys))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"container/list"
+	"slices"
+	"sync"
+)
+
+// nodeCache keeps the nodes last read from their pages, so the upper levels
+// of the trees aren't read and decoded again on every descent. It holds at
+// most size nodes and evicts the least recently used one. Cached nodes are
+// never changed: dal.getNode hands out copies whose items and children are
+// free to change, and only readers get the cached node itself.
+//
+// A page is dropped from the cache whenever it is written or freed, which
+// is how a commit invalidates the nodes it replaced.
+type nodeCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[pageNumber]*list.Element
+	lru     *list.List
+	hits    uint64
+	misses  uint64
+}
+
+// CacheStats counts the node reads served by the cache and those that had
+// to read the page.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Nodes  int
+}
+
+// newNodeCache returns nil, a cache that keeps nothing, when size is not
+// positive.
+func newNodeCache(size int) *nodeCache {
+	if size <= 0 {
+		return nil
+	}
+	return &nodeCache{
+		size:    size,
+		entries: map[pageNumber]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+func (nc *nodeCache) get(number pageNumber) (*Node, bool) {
+	if nc == nil {
+		return nil, false
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	element, ok := nc.entries[number]
+	if !ok {
+		nc.misses++
+		return nil, false
+	}
+	nc.hits++
+	nc.lru.MoveToFront(element)
+	return element.Value.(*Node), true
+}
+
+// add keeps node, which the caller must not change afterwards.
+func (nc *nodeCache) add(node *Node) {
+	if nc == nil {
+		return
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	if element, ok := nc.entries[node.pageNum]; ok {
+		element.Value = node
+		nc.lru.MoveToFront(element)
+		return
+	}
+	nc.entries[node.pageNum] = nc.lru.PushFront(node)
+	if nc.lru.Len() > nc.size {
+		oldest := nc.lru.Back()
+		nc.lru.Remove(oldest)
+		delete(nc.entries, oldest.Value.(*Node).pageNum)
+	}
+}
+
+func (nc *nodeCache) invalidate(number pageNumber) {
+	if nc == nil {
+		return
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	if element, ok := nc.entries[number]; ok {
+		nc.lru.Remove(element)
+		delete(nc.entries, number)
+	}
+}
+
+func (nc *nodeCache) clear() {
+	if nc == nil {
+		return
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	clear(nc.entries)
+	nc.lru.Init()
+}
+
+func (nc *nodeCache) stats() CacheStats {
+	if nc == nil {
+		return CacheStats{}
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	return CacheStats{nc.hits, nc.misses, nc.lru.Len()}
+}
+
+func (db *DB) CacheStats() CacheStats {
+	return db.cache.stats()
+}
+
+// copyNode copies the slices of node, leaving the items themselves shared
+// since they are never changed in place.
+func copyNode(node *Node) *Node {
+	return &Node{
+		pageNum:    node.pageNum,
+		items:      slices.Clone(node.items),
+		childNodes: slices.Clone(node.childNodes),
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNodeCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newNodeCache(2)
+	for _, number := range []pageNumber{1, 2} {
+		cache.add(&Node{pageNum: number})
+	}
+	if _, ok := cache.get(1); !ok {
+		t.Fatal("page 1 isn't cached")
+	}
+	// Page 2 is now the least recently used.
+	cache.add(&Node{pageNum: 3})
+	for number, want := range map[pageNumber]bool{1: true, 2: false, 3: true} {
+		if _, ok := cache.get(number); ok != want {
+			t.Errorf("page %d cached: %v, want %v", number, ok, want)
+		}
+	}
+
+	cache.invalidate(3)
+	if _, ok := cache.get(3); ok {
+		t.Error("page 3 is cached after being invalidated")
+	}
+	if got, want := cache.stats(), (CacheStats{3, 2, 1}); got != want {
+		t.Errorf("stats are %+v, want %+v", got, want)
+	}
+
+	// A cache of size 0 keeps nothing.
+	cache = newNodeCache(0)
+	cache.add(&Node{pageNum: 1})
+	if _, ok := cache.get(1); ok || cache.stats() != (CacheStats{}) {
+		t.Error("a disabled cache kept a node")
+	}
+}
+
+func TestCacheServesReads(t *testing.T) {
+	db := openTestDB(t, nil)
+	fillCollection(t, db, "c", 1000)
+	read := func(want string) {
+		t.Helper()
+		view(t, db, func(tx *Tx) error {
+			c, err := tx.GetCollection([]byte("c"))
+			if err != nil {
+				return err
+			}
+			for i := range 1000 {
+				item, err := c.Find(benchKey(i))
+				if err != nil {
+					return err
+				}
+				if item == nil || string(item.Value()) != want {
+					t.Fatalf("%s has %v, want %s", benchKey(i), item, want)
+				}
+			}
+			return nil
+		})
+	}
+
+	read("value")
+	before := db.CacheStats()
+	read("value")
+	after := db.CacheStats()
+	if after.Misses != before.Misses || after.Hits == before.Hits {
+		t.Errorf("reading again went from %+v to %+v", before, after)
+	}
+
+	// Writes replace the cached nodes.
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		for i := range 1000 {
+			if err := c.Put(benchKey(i), []byte("changed")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	read("changed")
+}
+
+func TestCachedNodesAreNotChanged(t *testing.T) {
+	db := openTestDB(t, nil)
+	fillCollection(t, db, "c", 10)
+
+	// A write that is rolled back leaves the cached nodes as they were.
+	tx := db.WriteTx()
+	c, err := tx.GetCollection([]byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 20 {
+		if err := c.Put([]byte(fmt.Sprintf("new%d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Remove(benchKey(0)); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		keys := collectionKeys(t, c)
+		if len(keys) != 10 || keys[0] != string(benchKey(0)) {
+			t.Errorf("the collection has %v after the rollback", keys)
+		}
+
+		// getNode hands out a copy to change.
+		node, err := tx.getNode(c.root)
+		if err != nil {
+			return err
+		}
+		node.items = node.items[:0]
+		cached, err := tx.readNode(c.root)
+		if err != nil {
+			return err
+		}
+		if len(cached.items) != 10 {
+			t.Errorf("the cached node has %d items after changing a copy", len(cached.items))
+		}
+		return nil
+	})
+}
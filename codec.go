@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+)
+
+// Codec converts values of type T to bytes and back. The key codecs below
+// preserve order: encoded keys compare with bytes.Compare the way the keys
+// themselves do, so cursors and ranges over a TypedCollection follow the
+// natural order of K.
+type Codec[T any] interface {
+	Encode(value T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+var invalidEncodingErr = errors.New("data does not have the size of the encoded type")
+
+const signBit = 1 << 63
+
+// Int64Codec writes big-endian with the sign bit flipped, so negative numbers
+// sort before positive ones.
+type Int64Codec struct{}
+
+func (Int64Codec) Encode(value int64) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, uint64(value)^signBit), nil
+}
+
+func (Int64Codec) Decode(data []byte) (int64, error) {
+	if len(data) != 8 {
+		return 0, invalidEncodingErr
+	}
+	return int64(binary.BigEndian.Uint64(data) ^ signBit), nil
+}
+
+type Uint64Codec struct{}
+
+func (Uint64Codec) Encode(value uint64) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, value), nil
+}
+
+func (Uint64Codec) Decode(data []byte) (uint64, error) {
+	if len(data) != 8 {
+		return 0, invalidEncodingErr
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+// StringCodec stores the UTF-8 bytes, which sort by code point.
+type StringCodec struct{}
+
+func (StringCodec) Encode(value string) ([]byte, error) {
+	return []byte(value), nil
+}
+
+func (StringCodec) Decode(data []byte) (string, error) {
+	return string(data), nil
+}
+
+// TimeCodec stores Unix nanoseconds like Int64Codec. Times are kept to the
+// nanosecond between the years 1678 and 2262 and decode in the local time
+// zone.
+type TimeCodec struct{}
+
+func (TimeCodec) Encode(value time.Time) ([]byte, error) {
+	return Int64Codec{}.Encode(value.UnixNano())
+}
+
+func (TimeCodec) Decode(data []byte) (time.Time, error) {
+	nanos, err := Int64Codec{}.Decode(data)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanos), nil
+}
+
+type UUID [16]byte
+
+// UUIDCodec stores the 16 bytes as they are, which sorts time-ordered
+// versions such as 7 by creation time.
+type UUIDCodec struct{}
+
+func (UUIDCodec) Encode(value UUID) ([]byte, error) {
+	return value[:], nil
+}
+
+func (UUIDCodec) Decode(data []byte) (UUID, error) {
+	var id UUID
+	if len(data) != len(id) {
+		return id, invalidEncodingErr
+	}
+	copy(id[:], data)
+	return id, nil
+}
+
+// BytesCodec stores byte slices as they are and works for keys and values.
+// Decode returns a copy, so the result stays valid after the transaction.
+type BytesCodec struct{}
+
+func (BytesCodec) Encode(value []byte) ([]byte, error) {
+	return value, nil
+}
+
+func (BytesCodec) Decode(data []byte) ([]byte, error) {
+	return slices.Clone(data), nil
+}
+
+// JSONCodec stores values with encoding/json. It does not preserve order
+// and is meant for values.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(value T) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+// GobCodec stores values with encoding/gob. It does not preserve order and
+// is meant for values.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(value T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value)
+	return value, err
+}
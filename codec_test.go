@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+// checkOrder fails unless values, which are in order, encode to bytes in the
+// same order and decode back to themselves.
+func checkOrder[T comparable](t *testing.T, codec Codec[T], values []T) {
+	t.Helper()
+	var previous []byte
+	for i, value := range values {
+		data, err := codec.Encode(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && bytes.Compare(previous, data) >= 0 {
+			t.Errorf("%v doesn't encode after %v", value, values[i-1])
+		}
+		previous = data
+		decoded, err := codec.Decode(data)
+		if err != nil || decoded != value {
+			t.Errorf("%v decoded to %v, %v", value, decoded, err)
+		}
+	}
+}
+
+func TestKeyCodecsKeepOrder(t *testing.T) {
+	checkOrder(t, Codec[int64](Int64Codec{}), []int64{math.MinInt64, -1000, -1, 0, 1, 1000, math.MaxInt64})
+	checkOrder(t, Codec[uint64](Uint64Codec{}), []uint64{0, 1, 255, 256, math.MaxUint64})
+	checkOrder(t, Codec[string](StringCodec{}), []string{"", "a", "ab", "b"})
+	checkOrder(t, Codec[UUID](UUIDCodec{}), []UUID{{0}, {0, 1}, {1}})
+
+	base := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	var times []time.Time
+	for _, offset := range []time.Duration{-time.Hour, 0, time.Nanosecond, time.Hour} {
+		times = append(times, base.Add(offset))
+	}
+	for i, value := range times {
+		data, err := TimeCodec{}.Encode(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := TimeCodec{}.Decode(data)
+		if err != nil || !decoded.Equal(value) {
+			t.Errorf("%v decoded to %v, %v", value, decoded, err)
+		}
+		if i > 0 {
+			previous, _ := TimeCodec{}.Encode(times[i-1])
+			if bytes.Compare(previous, data) >= 0 {
+				t.Errorf("%v doesn't encode after %v", value, times[i-1])
+			}
+		}
+	}
+}
+
+func TestCodecsRejectBadData(t *testing.T) {
+	if _, err := (Int64Codec{}).Decode([]byte{1, 2}); err != invalidEncodingErr {
+		t.Errorf("Int64Codec returned %v, want %v", err, invalidEncodingErr)
+	}
+	if _, err := (UUIDCodec{}).Decode([]byte{1, 2}); err != invalidEncodingErr {
+		t.Errorf("UUIDCodec returned %v, want %v", err, invalidEncodingErr)
+	}
+}
+
+func TestValueCodecs(t *testing.T) {
+	type point struct{ X, Y int }
+	for _, codec := range []Codec[point]{JSONCodec[point]{}, GobCodec[point]{}} {
+		data, err := codec.Encode(point{1, 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded, err := codec.Decode(data); err != nil || decoded != (point{1, 2}) {
+			t.Errorf("%T decoded %+v, %v", codec, decoded, err)
+		}
+	}
+
+	data := []byte("value")
+	decoded, _ := BytesCodec{}.Decode(data)
+	data[0] = 'V'
+	if string(decoded) != "value" {
+		t.Error("BytesCodec.Decode doesn't copy")
+	}
+}
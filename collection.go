@@ -3,30 +3,159 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
+	"errors"
+	"iter"
+	"math"
+	"time"
 )
 
 const (
 	collectionSize = 16
-	counterSize    = 4
+	sequenceSize   = 8
+
+	// collectionHeaderVersion is bumped when a header field changes meaning.
+	// Headers without a version field predate it and are read as version 0.
+	collectionHeaderVersion = 1
+)
+
+// Anything a collection header stores past its fixed part is written as a
+// tagged field: a one byte tag, a two byte length and the data, so new
+// fields can be added without breaking the headers already on disk. Tags
+// that are not known are skipped.
+const (
+	comparatorField uint8 = iota + 1
+	versionField
+	createdAtField
+	minFillPercentField
+	maxFillPercentField
+	compressionField
+	ttlField
+	metadataField
+	indexesField
+	uniqueIndexesField
+	quotaField
+	usageField
+	mergeOperatorField
+	historyField
+)
+
+var (
+	collectionExistsErr   = errors.New("collection already exists")
+	collectionNotFoundErr = errors.New("collection not found")
+	incompatibleValueErr  = errors.New("incompatible value")
+	itemTooLargeErr       = errors.New("key and value are too large for a page")
+	reservedNameErr       = errors.New("the key is reserved for internal collections")
+
+	unsupportedHeaderVersionErr = errors.New("collection header version is not supported")
+	comparatorChangeErr         = errors.New("the comparator of a collection can't be changed")
+	invalidFillPercentErr       = errors.New("fill percents must be between 0 and 1, with the minimum below the maximum")
 )
 
+type CollectionOptions struct {
+	// Comparator is the name of a comparator passed to RegisterComparator.
+	// Keys are ordered with bytes.Compare when it is empty.
+	Comparator string
+
+	// MinFillPercent, MaxFillPercent and Compression are advisory: they are
+	// kept with the collection and returned by Meta, for tools that rewrite
+	// it, but the tree follows the database-wide fill percents and stores
+	// values uncompressed. Zero and empty mean no preference.
+	MinFillPercent float32
+	MaxFillPercent float32
+	Compression    string
+
+	// TTL is the default lifetime of the items put into the collection.
+	TTL time.Duration
+
+	// Metadata is kept with the collection on behalf of the caller.
+	Metadata []byte
+
+	// MaxItems and MaxBytes limit the number of items and the size of their
+	// keys and values; zero means no limit. Put fails with ErrQuotaExceeded
+	// instead of going over either of them.
+	MaxItems uint64
+	MaxBytes uint64
+
+	// MergeOperator is the name of the merge operator used by Merge, either
+	// a built-in one or one passed to RegisterMergeOperator.
+	MergeOperator string
+
+	// History keeps the values keys had before they were replaced or
+	// removed, for History and GetAsOf. HistoryVersions keeps only the last
+	// versions of each key and HistoryAge only the versions replaced within
+	// that long; zero means no limit.
+	History         bool
+	HistoryVersions int
+	HistoryAge      time.Duration
+}
+
+// check rejects fill percents that no tree could follow.
+func (o *CollectionOptions) check() error {
+	if o.MinFillPercent < 0 || o.MaxFillPercent < 0 || o.MinFillPercent > 1 || o.MaxFillPercent > 1 {
+		return invalidFillPercentErr
+	}
+	if o.MinFillPercent != 0 && o.MaxFillPercent != 0 && o.MinFillPercent >= o.MaxFillPercent {
+		return invalidFillPercentErr
+	}
+	return nil
+}
+
+// CollectionMeta is everything a collection header records besides its
+// root and sequence.
+type CollectionMeta struct {
+	CollectionOptions
+	CreatedAt time.Time
+}
+
 type Collection struct {
-	name    []byte
-	root    pageNumber
-	tx      *Tx
-	counter uint64
+	name     []byte
+	root     pageNumber
+	tx       *Tx
+	sequence uint64
+	meta     CollectionMeta
+	compare  Comparator
+
+	// parent is the collection holding the header of this one; it is nil
+	// for the root catalog. internal collections hold bookkeeping and are
+	// hidden from GetCollection and Collections.
+	parent   *Collection
+	internal bool
+
+	// indexes names the indexes kept up to date by Put and Remove, and
+	// uniqueIndexes those of them that reject a value used by another key.
+	indexes       [][]byte
+	uniqueIndexes [][]byte
+
+	// usage is kept up to date by every write; usageKnown is false for
+	// headers written before it was, until the items are counted once.
+	usage      CollectionUsage
+	usageKnown bool
+
+	// dirty is set when the header has to be written back into the parent
+	// on commit. collections caches the handles of nested collections
+	// opened in this transaction so they all share the same header.
+	dirty       bool
+	collections map[string]*Collection
 }
 
 func NewCollection(name []byte, root pageNumber) *Collection {
 	return &Collection{
-		name: name,
-		root: root,
+		name:        name,
+		root:        root,
+		compare:     bytes.Compare,
+		collections: map[string]*Collection{},
 	}
 
 }
 func newEmptyCollection() *Collection {
-	return &Collection{}
+	return &Collection{
+		compare:     bytes.Compare,
+		collections: map[string]*Collection{},
+	}
+}
+
+func (c *Collection) Name() []byte {
+	return c.name
 }
 
 func (c *Collection) getNodes(indexes []int) ([]*Node, error) {
@@ -47,146 +176,920 @@ func (c *Collection) getNodes(indexes []int) ([]*Node, error) {
 	return nodes, nil
 }
 
+// Find returns the item stored under key, or nil if there is none. The item
+// may point into the mapping of the file, so it is only valid until the
+// transaction ends; Get returns a copy of the value.
 func (c *Collection) Find(key []byte) (*Item, error) {
-	node, err := c.tx.getNode(c.root)
-	if err != nil {
+	item, err := c.find(key)
+	if err != nil || item == nil || item.isCollection() {
+		return nil, err
+	}
+	return c.visible(item), nil
+}
+
+// Get returns a copy of the value stored under key, which stays valid after
+// the transaction, or nil if there is none.
+func (c *Collection) Get(key []byte) ([]byte, error) {
+	item, err := c.Find(key)
+	if err != nil || item == nil {
 		return nil, err
 	}
+	return item.CopyValue(), nil
+}
 
-	index, containingNode, _, err := node.findKey(key, true)
+// find descends the tree of c without recording the path, through nodes that
+// are read and not copied, so a lookup served by the cache doesn't allocate.
+func (c *Collection) find(key []byte) (*Item, error) {
+	node, err := c.tx.readNode(c.root)
+	for err == nil {
+		found, index := node.findKeyInNode(key, c.compare)
+		if found {
+			return node.items[index], nil
+		}
+		if node.isLeaf() {
+			return nil, nil
+		}
+		node, err = c.tx.readNode(node.childNodes[index])
+	}
+	return nil, err
+}
 
+func (c *Collection) Put(key []byte, value []byte) error {
+	return c.put(c.newItem(key, value))
+}
+
+// newItem makes the item Put stores, expiring after the default TTL of c if
+// it has one.
+func (c *Collection) newItem(key []byte, value []byte) *Item {
+	if c.meta.TTL > 0 {
+		return expiringItem(key, value, c.meta.TTL)
+	}
+	return NewItem(key, value)
+}
+
+// position is where a key is stored in the tree of a collection, or where it
+// would be inserted. ancestors holds the child indexes leading to node.
+type position struct {
+	node      *Node
+	index     int
+	ancestors []int
+	found     bool
+}
+
+// locate descends the tree of c once to find the position of key.
+func (c *Collection) locate(key []byte) (*position, error) {
+	if c.root == 0 {
+		return &position{}, nil
+	}
+	root, err := c.tx.getNode(c.root)
 	if err != nil {
 		return nil, err
 	}
-	if index == -1 {
-		return nil, nil
+
+	index, node, ancestors, err := root.findKey(key, c.compare)
+	if err != nil {
+		return nil, err
 	}
-	return containingNode.items[index], nil
+	found := index < len(node.items) && c.compare(node.items[index].key, key) == 0
+	return &position{node, index, ancestors, found}, nil
+}
 
+// item returns the item stored at pos, or nil if the key isn't there.
+func (pos *position) item() *Item {
+	if !pos.found {
+		return nil
+	}
+	return pos.node.items[pos.index]
 }
 
-func (c *Collection) Put(key []byte, value []byte) error {
+func (c *Collection) put(i *Item) error {
+	_, err := c.update(i.key, func(*Item) (*Item, error) {
+		return i, nil
+	})
+	return err
+}
+
+// update replaces the item stored under key with the one fn makes from it,
+// as callers of c see it, and returns the new item. When fn returns nil
+// the key is left alone. The item is looked up by the same descent that
+// writes the new one.
+func (c *Collection) update(key []byte, fn func(current *Item) (*Item, error)) (*Item, error) {
 	if !c.tx.write {
-		return writeInsideReadTxErr
+		return nil, writeInsideReadTxErr
 	}
-	i := NewItem(key, value)
 
-	var root *Node
-	var err error
-	if c.root == 0 {
-		root = c.tx.writeNode(c.tx.newNode([]*Item{i}, []pageNumber{}))
+	pos, err := c.locate(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.updateAt(pos, fn)
+}
+
+// updateAt is update for a position the caller already located.
+func (c *Collection) updateAt(pos *position, fn func(current *Item) (*Item, error)) (*Item, error) {
+	old := pos.item()
+	i, err := fn(c.current(old))
+	if err != nil || i == nil {
+		return nil, err
+	}
+	if !c.internal && !i.isInternal() && c.isReservedName(i.key) {
+		return nil, reservedNameErr
+	}
+	if old != nil && old.isCollection() != i.isCollection() {
+		return nil, incompatibleValueErr
+	}
+	if itemSize(i) > c.tx.db.maxItemSize() {
+		return nil, itemTooLargeErr
+	}
+
+	// None of this writes to the tree of c, so pos stays valid.
+	var indexes []*Index
+	if !i.isCollection() {
+		indexes, err = c.openIndexes()
 		if err != nil {
-			return nil
+			return nil, err
+		}
+		for _, index := range indexes {
+			if err := index.check(i); err != nil {
+				return nil, err
+			}
+		}
+		if err := c.loadUsage(); err != nil {
+			return nil, err
+		}
+		if err := c.checkQuota(old, i); err != nil {
+			return nil, err
 		}
-		c.root = root.pageNum
+		if err := c.checkHistory(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.checkExpiry(old, i); err != nil {
+		return nil, err
+	}
+
+	if err := c.insertAt(pos, i); err != nil {
+		return nil, err
+	}
+	if old != nil && old.isBlob() {
+		if err := c.tx.releaseBlob(old); err != nil {
+			return nil, err
+		}
+	}
+	c.track(old, i)
+	if err := updateIndexes(indexes, old, i); err != nil {
+		return nil, err
+	}
+	if err := c.updateExpiry(old, i); err != nil {
+		return nil, err
+	}
+	if !i.isCollection() {
+		if err := c.recordHistory(i.key, old); err != nil {
+			return nil, err
+		}
+	}
+	return i, nil
+}
+
+// current is item as callers of c see it, for the callbacks of update and
+// the conditions of removeIf.
+func (c *Collection) current(item *Item) *Item {
+	if item == nil {
 		return nil
+	}
+	return c.visible(item)
+}
+
+// insertAt writes i at pos and splits the nodes that outgrew their page on
+// the way back up.
+func (c *Collection) insertAt(pos *position, i *Item) error {
+	if pos.node == nil {
+		root := c.tx.writeNode(c.tx.newNode([]*Item{i}, []pageNumber{}))
+		c.setRoot(root.pageNum)
+		return nil
+	}
+
+	if pos.found {
+		pos.node.items[pos.index] = i
 	} else {
-		root, err = c.tx.getNode(c.root)
+		pos.node.addItem(i, pos.index)
+	}
+	pos.node.writeNode(pos.node)
+
+	ancestors, err := c.getNodes(pos.ancestors)
+	if err != nil {
+		return err
+	}
+	for i := len(ancestors) - 2; i >= 0; i-- {
+		pnode := ancestors[i]
+		node := ancestors[i+1]
+		pnode.splitOverpopulated(node, pos.ancestors[i+1])
+	}
+
+	c.splitRoot(ancestors[0])
+	return nil
+}
+
+// splitRoot gives the collection a new root once the old one has outgrown
+// its page.
+func (c *Collection) splitRoot(rootNode *Node) {
+	for rootNode.isOverPopulated() {
+		newRoot := c.tx.writeNode(c.tx.newNode([]*Item{}, []pageNumber{rootNode.pageNum}))
+		newRoot.splitOverpopulated(rootNode, 0)
+		c.setRoot(newRoot.pageNum)
+		rootNode = newRoot
+	}
+}
+
+func (c *Collection) Remove(key []byte) error {
+	return c.remove(key, false)
+}
+
+// CompareAndSwap replaces the value stored under key with value if it is
+// currently old, and reports whether it did. The key keeps its expiry time.
+// A blob never matches, as its value isn't read.
+func (c *Collection) CompareAndSwap(key, old, value []byte) (bool, error) {
+	item, err := c.rewrite(key, func(current *Item) ([]byte, bool, error) {
+		if current == nil || current.isCollection() || current.isBlob() || !bytes.Equal(current.value, old) {
+			return nil, false, nil
+		}
+		return value, true, nil
+	})
+	return item != nil, err
+}
+
+// PutIfAbsent stores value under key unless the key is already there, and
+// reports whether it did.
+func (c *Collection) PutIfAbsent(key, value []byte) (bool, error) {
+	item, err := c.update(key, func(current *Item) (*Item, error) {
+		if current != nil {
+			return nil, nil
+		}
+		return c.newItem(key, value), nil
+	})
+	return item != nil, err
+}
+
+// DeleteIfEquals removes key if its value is currently old, and reports
+// whether it did.
+func (c *Collection) DeleteIfEquals(key, old []byte) (bool, error) {
+	return c.removeIf(key, false, func(current *Item) bool {
+		return current != nil && !current.isCollection() && !current.isBlob() && bytes.Equal(current.value, old)
+	})
+}
+
+func (c *Collection) remove(key []byte, collection bool) error {
+	_, err := c.removeIf(key, collection, nil)
+	return err
+}
+
+// removeIf removes the item under key if cond accepts it, as callers of c
+// see it, and reports whether it did. A nil cond accepts anything.
+func (c *Collection) removeIf(key []byte, collection bool, cond func(current *Item) bool) (bool, error) {
+	if !c.tx.write {
+		return false, writeInsideReadTxErr
+	}
+	var indexes []*Index
+	if !collection {
+		var err error
+		indexes, err = c.openIndexes()
 		if err != nil {
-			return err
+			return false, err
+		}
+		if err := c.loadUsage(); err != nil {
+			return false, err
+		}
+		if err := c.checkHistory(); err != nil {
+			return false, err
 		}
 	}
 
-	insertionIndex, nodeToInsertIn, ancestorsIndexes, err := root.findKey(i.key, false)
-	fmt.Printf("findkey result: %v  %v  %v  %v\n", insertionIndex, nodeToInsertIn, ancestorsIndexes, err)
+	pos, err := c.locate(key)
 	if err != nil {
-		return err
+		return false, err
+	}
+	removed := pos.item()
+	if removed == nil || cond != nil && !cond(c.current(removed)) {
+		return false, nil
+	}
+	if removed.isCollection() != collection {
+		return false, incompatibleValueErr
+	}
+	if err := c.checkExpiry(removed, nil); err != nil {
+		return false, err
 	}
 
-	if nodeToInsertIn.items != nil && insertionIndex < len(nodeToInsertIn.items) && bytes.Compare(nodeToInsertIn.items[insertionIndex].key, key) == 0 {
-		nodeToInsertIn.items[insertionIndex] = i
+	if err := c.removeAt(pos); err != nil {
+		return false, err
+	}
+	if removed.isBlob() {
+		if err := c.tx.releaseBlob(removed); err != nil {
+			return false, err
+		}
+	}
+	c.track(removed, nil)
+	if err := updateIndexes(indexes, removed, nil); err != nil {
+		return false, err
+	}
+	if err := c.updateExpiry(removed, nil); err != nil {
+		return false, err
+	}
+	if !collection {
+		if err := c.recordHistory(removed.key, removed); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// removeAt takes the item at pos out of the tree and rebalances the nodes on
+// the way back up.
+func (c *Collection) removeAt(pos *position) error {
+	ancestorsIndexes := pos.ancestors
+	if pos.node.isLeaf() {
+		pos.node.removeItemFromLeaf(pos.index)
 	} else {
-		nodeToInsertIn.addItem(i, insertionIndex)
+		affectedNodes, err := pos.node.removeItemFromInternal(pos.index)
+		if err != nil {
+			return err
+		}
+		ancestorsIndexes = append(ancestorsIndexes, affectedNodes...)
 	}
-	nodeToInsertIn.writeNode(nodeToInsertIn)
 
 	ancestors, err := c.getNodes(ancestorsIndexes)
 	if err != nil {
 		return err
 	}
+
+	// Replacing a separator with a longer one or taking one from the node
+	// below can also leave a node larger than a page, so every node on the
+	// way back up is either rebalanced or split.
 	for i := len(ancestors) - 2; i >= 0; i-- {
 		pnode := ancestors[i]
 		node := ancestors[i+1]
-		nodeIndex := ancestorsIndexes[i+1]
-		if node.isOverPopulated() {
-			pnode.split(node, nodeIndex)
+		if node.isUnderPopulated() {
+			err = pnode.rebalanceRemove(node, ancestorsIndexes[i+1])
+			if err != nil {
+				return err
+			}
+		} else {
+			pnode.splitOverpopulated(node, ancestorsIndexes[i+1])
 		}
 	}
 
 	rootNode := ancestors[0]
-	if rootNode.isOverPopulated() {
-		newRoot := c.tx.newNode([]*Item{}, []pageNumber{rootNode.pageNum})
-		newRoot.split(rootNode, 0)
-		newRoot = c.tx.writeNode(newRoot)
+	if len(rootNode.items) == 0 && len(rootNode.childNodes) > 0 {
+		c.tx.deleteNode(rootNode)
+		c.setRoot(rootNode.childNodes[0])
+	} else {
+		c.splitRoot(rootNode)
+	}
+	return nil
+}
+
+// DeleteRange removes every key k with start <= k < end. A nil start or end
+// leaves that side of the range open.
+func (c *Collection) DeleteRange(start, end []byte) error {
+	if !c.tx.write {
+		return writeInsideReadTxErr
+	}
+	if start != nil && end != nil && c.compare(start, end) >= 0 {
+		return nil
+	}
+	if len(c.indexes) != 0 || c.meta.History {
+		return c.deleteRangeByKey(start, end)
+	}
+	if err := c.loadUsage(); err != nil {
+		return err
+	}
+
+	rootNode, err := c.tx.getNode(c.root)
+	if err != nil {
+		return err
+	}
+
+	separators, err := c.deleteRange(rootNode, start, end, nil)
+	if err != nil {
+		return err
+	}
+	c.splitRoot(rootNode)
+
+	for len(rootNode.items) == 0 && len(rootNode.childNodes) == 1 {
+		c.tx.deleteNode(rootNode)
+		c.setRoot(rootNode.childNodes[0])
+		rootNode, err = c.tx.getNode(c.root)
 		if err != nil {
 			return err
 		}
+	}
+
+	for _, item := range separators {
+		if item.isCollection() {
+			if err := c.release(item); err != nil {
+				return err
+			}
+		}
+		if err := c.remove(item.key, item.isCollection()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		c.root = newRoot.pageNum
+// deleteRangeByKey removes the range one key at a time, so that indexes and
+// history see every removed item. Internal collections are left alone.
+func (c *Collection) deleteRangeByKey(start, end []byte) error {
+	var items []*Item
+	cursor := c.Cursor()
+	item, err := cursor.seek(start)
+	for ; item != nil && (end == nil || c.compare(item.key, end) < 0); item, err = cursor.next() {
+		if !item.isInternal() {
+			items = append(items, item)
+		}
+	}
+	if err != nil {
+		return err
 	}
 
+	for _, item := range items {
+		if item.isCollection() {
+			if err := c.release(item); err != nil {
+				return err
+			}
+		}
+		if err := c.remove(item.key, item.isCollection()); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (c *Collection) Remove(key []byte) error {
+// deleteRange drops the items and subtrees of node that fall inside the range
+// and descends only into the (at most two) children straddling its bounds.
+// When a run of items is dropped from an internal node, the last of them is
+// kept as the separator between the surviving boundary children and returned
+// so the caller can remove it through the regular path afterwards.
+func (c *Collection) deleteRange(node *Node, start, end []byte, separators []*Item) ([]*Item, error) {
+	lo := 0
+	if start != nil {
+		_, lo = node.findKeyInNode(start, c.compare)
+	}
+	hi := len(node.items)
+	if end != nil {
+		_, hi = node.findKeyInNode(end, c.compare)
+	}
+
+	if node.isLeaf() {
+		if lo < hi {
+			if err := c.releaseItems(node.items[lo:hi]); err != nil {
+				return nil, err
+			}
+			node.items = append(node.items[:lo], node.items[hi:]...)
+			c.tx.writeNode(node)
+		}
+		return separators, nil
+	}
+
+	boundaries := []int{lo}
+	if lo < hi {
+		if err := c.releaseItems(node.items[lo : hi-1]); err != nil {
+			return nil, err
+		}
+		for _, child := range node.childNodes[lo+1 : hi] {
+			if err := c.dropTree(child); err != nil {
+				return nil, err
+			}
+		}
+		separators = append(separators, node.items[hi-1])
+		node.items = append(node.items[:lo], node.items[hi-1:]...)
+		node.childNodes = append(node.childNodes[:lo+1], node.childNodes[hi:]...)
+		c.tx.writeNode(node)
+		boundaries = []int{lo + 1, lo}
+	}
+
+	for _, index := range boundaries {
+		child, err := c.tx.getNode(node.childNodes[index])
+		if err != nil {
+			return nil, err
+		}
+		separators, err = c.deleteRange(child, start, end, separators)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, index := range boundaries {
+		if index >= len(node.childNodes) || len(node.childNodes) < 2 {
+			continue
+		}
+		child, err := c.tx.getNode(node.childNodes[index])
+		if err != nil {
+			return nil, err
+		}
+		if child.isUnderPopulated() {
+			if err := node.rebalanceRemove(child, index); err != nil {
+				return nil, err
+			}
+		}
+	}
+	node.splitOverpopulatedChildren()
+	return separators, nil
+}
+
+func (c *Collection) CreateCollection(name []byte, options *CollectionOptions) (*Collection, error) {
+	return c.createCollection(name, options, false)
+}
+
+func (c *Collection) createCollection(name []byte, options *CollectionOptions, internal bool) (*Collection, error) {
+	if !c.tx.write {
+		return nil, writeInsideReadTxErr
+	}
+	if !internal && c.isReservedName(name) {
+		return nil, reservedNameErr
+	}
+	if options == nil {
+		options = &CollectionOptions{}
+	}
+	if err := options.check(); err != nil {
+		return nil, err
+	}
+	compare, err := getComparator(options.Comparator)
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := c.find(name)
+	if err != nil {
+		return nil, err
+	}
+	if item != nil {
+		if item.isCollection() {
+			return nil, collectionExistsErr
+		}
+		return nil, incompatibleValueErr
+	}
+
+	rootNode := c.tx.writeNode(c.tx.newNode([]*Item{}, []pageNumber{}))
+	collection := newEmptyCollection()
+	collection.name = name
+	collection.root = rootNode.pageNum
+	collection.meta = CollectionMeta{
+		CollectionOptions: *options,
+		CreatedAt:         time.Now(),
+	}
+	collection.compare = compare
+	collection.tx = c.tx
+	collection.parent = c
+	collection.internal = internal
+	collection.usageKnown = true
+	if err := c.put(collection.serialize()); err != nil {
+		return nil, err
+	}
+	c.tx.countComparator(options.Comparator, 1)
+	c.collections[string(name)] = collection
+	return collection, nil
+}
+
+func (c *Collection) GetCollection(name []byte) (*Collection, error) {
+	item, err := c.find(name)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil || !item.isCollection() || item.isInternal() {
+		return nil, nil
+	}
+	return c.openCollection(item)
+}
+
+// internalCollection returns the hidden collection kept in c under name,
+// creating it first when create is set and it doesn't exist yet. It fails
+// if an item of the user, written before the name was reserved, is in the
+// way.
+func (c *Collection) internalCollection(name []byte, create bool) (*Collection, error) {
+	item, err := c.find(name)
+	if err != nil {
+		return nil, err
+	}
+	if item != nil && item.isInternal() {
+		return c.openCollection(item)
+	}
+	if item != nil {
+		return nil, reservedNameErr
+	}
+	if !create {
+		return nil, nil
+	}
+	return c.createCollection(name, nil, true)
+}
+
+// isReservedName reports whether name is one that internal collections are
+// kept under in c, which Put and CreateCollection refuse. The ttl
+// collection is only kept in the root catalog.
+func (c *Collection) isReservedName(name []byte) bool {
+	if c.parent == nil && bytes.Equal(name, ttlCollectionName) {
+		return true
+	}
+	return bytes.HasPrefix(name, indexCollectionName(nil)) || string(name) == historyCollectionName
+}
+
+func (c *Collection) CreateCollectionIfNotExists(name []byte, options *CollectionOptions) (*Collection, error) {
+	collection, err := c.GetCollection(name)
+	if err != nil || collection != nil {
+		return collection, err
+	}
+	return c.CreateCollection(name, options)
+}
+
+// Collections iterates over the collections nested directly in c, in name
+// order.
+func (c *Collection) Collections() iter.Seq2[*Collection, error] {
+	return func(yield func(*Collection, error) bool) {
+		// The headers are read as stored, which cursors hide.
+		cursor := c.Cursor()
+		for item, err := cursor.first(); ; item, err = cursor.next() {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if item == nil {
+				return
+			}
+			if !item.isCollection() || item.isInternal() {
+				continue
+			}
+			collection, err := c.openCollection(item)
+			if !yield(collection, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *Collection) RenameCollection(oldName, newName []byte) error {
 	if !c.tx.write {
 		return writeInsideReadTxErr
 	}
-	rootNode, err := c.tx.getNode(c.root)
+	if c.isReservedName(newName) {
+		return reservedNameErr
+	}
+
+	item, err := c.find(oldName)
+	if err != nil {
+		return err
+	}
+	if item == nil || item.isInternal() {
+		return collectionNotFoundErr
+	}
+	if !item.isCollection() {
+		return incompatibleValueErr
+	}
+
+	existing, err := c.find(newName)
 	if err != nil {
 		return err
 	}
+	if existing != nil {
+		return collectionExistsErr
+	}
 
-	removeItemIndex, nodeToRemoveFrom, ancestorsIndexes, err := rootNode.findKey(key, true)
+	collection, err := c.openCollection(item)
 	if err != nil {
 		return err
 	}
+	collection.name = newName
+	if err := c.put(collection.serialize()); err != nil {
+		return err
+	}
+	delete(c.collections, string(oldName))
+	c.collections[string(newName)] = collection
+	if err := c.remove(oldName, true); err != nil {
+		return err
+	}
+	oldPath, newPath := append(c.path(), oldName), collection.path()
+	c.tx.renameExtractors(oldPath, newPath)
+	return c.tx.renameExpiring(oldPath, newPath)
+}
 
-	if removeItemIndex == -1 {
+// path lists the names leading from the root catalog to c.
+func (c *Collection) path() [][]byte {
+	if c.parent == nil {
 		return nil
 	}
+	return append(c.parent.path(), c.name)
+}
 
-	if nodeToRemoveFrom.isLeaf() {
-		nodeToRemoveFrom.removeItemFromLeaf(removeItemIndex)
-	} else {
-		affectedNodes, err := nodeToRemoveFrom.removeItemFromInternal(removeItemIndex)
-		if err != nil {
-			return err
+// appendPath encodes path as a count followed by each length-prefixed name.
+func appendPath(b []byte, path [][]byte) []byte {
+	b = append(b, byte(len(path)))
+	for _, name := range path {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(name)))
+		b = append(b, name...)
+	}
+	return b
+}
+
+// readPath decodes a path written by appendPath and returns the bytes that
+// follow it.
+func readPath(b []byte) ([][]byte, []byte) {
+	pos := 0
+	path := make([][]byte, int(b[pos]))
+	pos += 1
+	for i := range path {
+		size := int(binary.BigEndian.Uint16(b[pos:]))
+		pos += 2
+		path[i] = b[pos : pos+size]
+		pos += size
+	}
+	return path, b[pos:]
+}
+
+// movePath replaces the oldPath prefix of path with newPath.
+func movePath(path, oldPath, newPath [][]byte) [][]byte {
+	return append(append([][]byte{}, newPath...), path[len(oldPath):]...)
+}
+
+func hasPathPrefix(path, prefix [][]byte) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if string(path[i]) != string(prefix[i]) {
+			return false
 		}
-		ancestorsIndexes = append(ancestorsIndexes, affectedNodes...)
 	}
+	return true
+}
 
-	ancestors, err := c.getNodes(ancestorsIndexes)
+func (c *Collection) openCollection(item *Item) (*Collection, error) {
+	if collection, ok := c.collections[string(item.key)]; ok {
+		return collection, nil
+	}
+	collection := newEmptyCollection()
+	if err := collection.deserialize(item); err != nil {
+		return nil, err
+	}
+	compare, err := getComparator(collection.meta.Comparator)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	collection.compare = compare
+	collection.tx = c.tx
+	collection.parent = c
+	c.collections[string(item.key)] = collection
+	return collection, nil
+}
 
-	for i := len(ancestors) - 2; i >= 0; i-- {
-		pnode := ancestors[i]
-		node := ancestors[i+1]
-		if node.isUnderPopulated() {
-			err = pnode.rebalanceRemove(node, ancestorsIndexes[i+1])
-			if err != nil {
+// flush writes the headers of the nested collections that changed in this
+// transaction back into c, deepest first.
+func (c *Collection) flush() error {
+	for _, collection := range c.collections {
+		if err := collection.flush(); err != nil {
+			return err
+		}
+		if collection.dirty {
+			if err := c.put(collection.serialize()); err != nil {
 				return err
 			}
+			collection.dirty = false
 		}
 	}
+	return nil
+}
 
-	rootNode = ancestors[0]
-	if len(rootNode.items) == 0 && len(rootNode.childNodes) > 0 {
-		c.root = ancestors[1].pageNum
+// DeleteCollection removes the named collection and releases every page of
+// its tree, along with those of the collections nested in it.
+func (c *Collection) DeleteCollection(name []byte) error {
+	if !c.tx.write {
+		return writeInsideReadTxErr
+	}
+
+	item, err := c.find(name)
+	if err != nil {
+		return err
+	}
+	if item == nil || item.isInternal() {
+		return collectionNotFoundErr
+	}
+	if !item.isCollection() {
+		return incompatibleValueErr
+	}
+
+	if err := c.release(item); err != nil {
+		return err
 	}
+	return c.remove(name, true)
+}
+
+// release frees the pages item owns. For a nested collection with an open
+// handle, it frees the tree the handle points at, as the header in c is only
+// brought up to date on commit, and forgets the handle so that flush doesn't
+// write the header of a dropped collection back.
+func (c *Collection) release(item *Item) error {
+	if collection, ok := c.collections[string(item.key)]; ok && item.isCollection() {
+		delete(c.collections, string(item.key))
+		if err := collection.flush(); err != nil {
+			return err
+		}
+		item = collection.serialize()
+	}
+	return c.tx.releaseItem(item)
+}
 
+// releaseItems frees the pages owned by items that are being dropped from c
+// and takes them out of its usage.
+func (c *Collection) releaseItems(items []*Item) error {
+	for _, item := range items {
+		if err := c.release(item); err != nil {
+			return err
+		}
+		c.track(item, nil)
+	}
 	return nil
 }
-func (c *Collection) ID() uint64 {
+
+// dropTree releases a subtree that is being cut out of c.
+func (c *Collection) dropTree(pageNum pageNumber) error {
+	node, err := c.tx.getNode(pageNum)
+	if err != nil {
+		return err
+	}
+	if err := c.releaseItems(node.items); err != nil {
+		return err
+	}
+	for _, child := range node.childNodes {
+		if err := c.dropTree(child); err != nil {
+			return err
+		}
+	}
+	c.tx.deleteNode(node)
+	return nil
+}
+
+func (c *Collection) setRoot(root pageNumber) {
+	c.root = root
+	c.dirty = true
+}
+
+// NextSequence increments the sequence of the collection and returns the new
+// value. The sequence is stored with the collection when the transaction
+// commits.
+func (c *Collection) NextSequence() (uint64, error) {
 	if !c.tx.write {
-		return 0
+		return 0, writeInsideReadTxErr
 	}
+	c.sequence++
+	c.dirty = true
+	return c.sequence, nil
+}
 
-	id := c.counter
-	c.counter += 1
-	return id
+func (c *Collection) Sequence() uint64 {
+	return c.sequence
+}
+
+func (c *Collection) SetSequence(sequence uint64) error {
+	if !c.tx.write {
+		return writeInsideReadTxErr
+	}
+	c.sequence = sequence
+	c.dirty = true
+	return nil
+}
+
+func (c *Collection) Meta() CollectionMeta {
+	return c.meta
+}
+
+// SetCollectionMeta replaces the metadata of the named collection nested in
+// c. CreatedAt is kept from the existing header and the comparator has to
+// stay the same.
+func (c *Collection) SetCollectionMeta(name []byte, meta CollectionMeta) error {
+	if !c.tx.write {
+		return writeInsideReadTxErr
+	}
+
+	collection, err := c.GetCollection(name)
+	if err != nil {
+		return err
+	}
+	if collection == nil {
+		return collectionNotFoundErr
+	}
+	if meta.Comparator != collection.meta.Comparator {
+		return comparatorChangeErr
+	}
+	if err := meta.check(); err != nil {
+		return err
+	}
+	if meta.History && !collection.meta.History {
+		if _, err := collection.internalCollection([]byte(historyCollectionName), false); err != nil {
+			return err
+		}
+	}
+
+	meta.CreatedAt = collection.meta.CreatedAt
+	collection.meta = meta
+	collection.dirty = true
+	return nil
 }
 
 func (c *Collection) serialize() *Item {
@@ -194,20 +1097,145 @@ func (c *Collection) serialize() *Item {
 	leftPos := 0
 	binary.LittleEndian.PutUint64(b[leftPos:], uint64(c.root))
 	leftPos += pageNumberSize
-	binary.LittleEndian.PutUint64(b[leftPos:], c.counter)
-	leftPos += counterSize
-	return NewItem(c.name, b)
+	binary.LittleEndian.PutUint64(b[leftPos:], c.sequence)
+	leftPos += sequenceSize
+
+	b = appendField(b, versionField, []byte{collectionHeaderVersion})
+	if c.meta.Comparator != "" {
+		b = appendField(b, comparatorField, []byte(c.meta.Comparator))
+	}
+	if !c.meta.CreatedAt.IsZero() {
+		b = appendField(b, createdAtField, binary.LittleEndian.AppendUint64(nil, uint64(c.meta.CreatedAt.UnixNano())))
+	}
+	if c.meta.MinFillPercent != 0 {
+		b = appendField(b, minFillPercentField, binary.LittleEndian.AppendUint32(nil, math.Float32bits(c.meta.MinFillPercent)))
+	}
+	if c.meta.MaxFillPercent != 0 {
+		b = appendField(b, maxFillPercentField, binary.LittleEndian.AppendUint32(nil, math.Float32bits(c.meta.MaxFillPercent)))
+	}
+	if c.meta.Compression != "" {
+		b = appendField(b, compressionField, []byte(c.meta.Compression))
+	}
+	if c.meta.TTL != 0 {
+		b = appendField(b, ttlField, binary.LittleEndian.AppendUint64(nil, uint64(c.meta.TTL)))
+	}
+	if len(c.meta.Metadata) != 0 {
+		b = appendField(b, metadataField, c.meta.Metadata)
+	}
+	if len(c.indexes) != 0 {
+		b = appendField(b, indexesField, appendNames(nil, c.indexes))
+	}
+	if len(c.uniqueIndexes) != 0 {
+		b = appendField(b, uniqueIndexesField, appendNames(nil, c.uniqueIndexes))
+	}
+	if c.meta.MaxItems != 0 || c.meta.MaxBytes != 0 {
+		quota := binary.LittleEndian.AppendUint64(nil, c.meta.MaxItems)
+		b = appendField(b, quotaField, binary.LittleEndian.AppendUint64(quota, c.meta.MaxBytes))
+	}
+	if c.usageKnown {
+		usage := binary.LittleEndian.AppendUint64(nil, c.usage.Items)
+		b = appendField(b, usageField, binary.LittleEndian.AppendUint64(usage, c.usage.Bytes))
+	}
+	if c.meta.MergeOperator != "" {
+		b = appendField(b, mergeOperatorField, []byte(c.meta.MergeOperator))
+	}
+	if c.meta.History {
+		history := binary.LittleEndian.AppendUint64(nil, uint64(c.meta.HistoryVersions))
+		b = appendField(b, historyField, binary.LittleEndian.AppendUint64(history, uint64(c.meta.HistoryAge)))
+	}
+	flags := collectionItemFlag
+	if c.internal {
+		flags |= internalItemFlag
+	}
+	return &Item{key: c.name, value: b, flags: flags}
 }
 
-func (c *Collection) deserialize(item *Item) {
-	c.name = item.key
+// deserialize copies what it keeps of item, as the item may point into the
+// mapping of the file and the collection, its name and its metadata can
+// outlive the transaction.
+func (c *Collection) deserialize(item *Item) error {
+	c.name = bytes.Clone(item.key)
+	c.internal = item.isInternal()
 
 	if len(item.value) != 0 {
 		leftPos := 0
 		c.root = pageNumber(binary.LittleEndian.Uint64(item.value[leftPos:]))
 		leftPos += pageNumberSize
 
-		c.counter = binary.LittleEndian.Uint64(item.value[leftPos:])
-		leftPos += pageNumberSize
+		c.sequence = binary.LittleEndian.Uint64(item.value[leftPos:])
+		leftPos += sequenceSize
+
+		for leftPos < len(item.value) {
+			tag := item.value[leftPos]
+			leftPos += 1
+			size := int(binary.LittleEndian.Uint16(item.value[leftPos:]))
+			leftPos += 2
+			data := item.value[leftPos : leftPos+size]
+			leftPos += size
+
+			switch tag {
+			case versionField:
+				if data[0] > collectionHeaderVersion {
+					return unsupportedHeaderVersionErr
+				}
+			case comparatorField:
+				c.meta.Comparator = string(data)
+			case createdAtField:
+				c.meta.CreatedAt = time.Unix(0, int64(binary.LittleEndian.Uint64(data)))
+			case minFillPercentField:
+				c.meta.MinFillPercent = math.Float32frombits(binary.LittleEndian.Uint32(data))
+			case maxFillPercentField:
+				c.meta.MaxFillPercent = math.Float32frombits(binary.LittleEndian.Uint32(data))
+			case compressionField:
+				c.meta.Compression = string(data)
+			case ttlField:
+				c.meta.TTL = time.Duration(binary.LittleEndian.Uint64(data))
+			case metadataField:
+				c.meta.Metadata = bytes.Clone(data)
+			case indexesField:
+				c.indexes = readNames(data)
+			case uniqueIndexesField:
+				c.uniqueIndexes = readNames(data)
+			case quotaField:
+				c.meta.MaxItems = binary.LittleEndian.Uint64(data)
+				c.meta.MaxBytes = binary.LittleEndian.Uint64(data[8:])
+			case usageField:
+				c.usage.Items = binary.LittleEndian.Uint64(data)
+				c.usage.Bytes = binary.LittleEndian.Uint64(data[8:])
+				c.usageKnown = true
+			case mergeOperatorField:
+				c.meta.MergeOperator = string(data)
+			case historyField:
+				c.meta.History = true
+				c.meta.HistoryVersions = int(binary.LittleEndian.Uint64(data))
+				c.meta.HistoryAge = time.Duration(binary.LittleEndian.Uint64(data[8:]))
+			}
+		}
+	}
+	return nil
+}
+
+func appendField(buf []byte, tag uint8, data []byte) []byte {
+	buf = append(buf, tag)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(data)))
+	return append(buf, data...)
+}
+
+func appendNames(buf []byte, names [][]byte) []byte {
+	for _, name := range names {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(name)))
+		buf = append(buf, name...)
+	}
+	return buf
+}
+
+func readNames(data []byte) [][]byte {
+	var names [][]byte
+	for pos := 0; pos < len(data); {
+		size := int(binary.LittleEndian.Uint16(data[pos:]))
+		pos += 2
+		names = append(names, bytes.Clone(data[pos:pos+size]))
+		pos += size
 	}
+	return names
 }
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"fmt"
+	"iter"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func fillCollection(tb testing.TB, db *DB, name string, count int) {
+	tb.Helper()
+	update(tb, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte(name), nil)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < count; i++ {
+			if err := c.Put(benchKey(i), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// benchOptions keeps every node of the benchmark trees cached, so lookups
+// measure hits.
+func benchOptions(options *Options) {
+	options.CacheSize = 8192
+}
+
+func benchKey(i int) []byte {
+	return []byte(fmt.Sprintf("key%08d", i))
+}
+
+func TestFindDoesNotAllocate(t *testing.T) {
+	db := openTestDB(t, nil)
+	fillCollection(t, db, "c", 10000)
+
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		hit, miss := benchKey(4321), []byte("key9")
+		var findErr error
+		allocs := testing.AllocsPerRun(100, func() {
+			if item, err := c.Find(hit); err != nil || item == nil {
+				findErr = fmt.Errorf("Find(%q) = %v, %v", hit, item, err)
+			}
+			if item, err := c.Find(miss); err != nil || item != nil {
+				findErr = fmt.Errorf("Find(%q) = %v, %v", miss, item, err)
+			}
+		})
+		if findErr != nil {
+			return findErr
+		}
+		if allocs != 0 {
+			t.Errorf("Find allocated %v times per run", allocs)
+		}
+		return nil
+	})
+}
+
+func BenchmarkFind(b *testing.B) {
+	db := openTestDB(b, benchOptions)
+	fillCollection(b, db, "c", 100000)
+	keys := make([][]byte, 1024)
+	for i := range keys {
+		keys[i] = benchKey(i * 97)
+	}
+
+	tx := db.ReadTx()
+	defer tx.Rollback()
+	c, err := tx.GetCollection([]byte("c"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Find(keys[i%len(keys)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	db := openTestDB(b, benchOptions)
+	fillCollection(b, db, "c", 100000)
+	keys := make([][]byte, 1024)
+	for i := range keys {
+		keys[i] = benchKey(i * 97)
+	}
+
+	tx := db.ReadTx()
+	defer tx.Rollback()
+	c, err := tx.GetCollection([]byte("c"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Get(keys[i%len(keys)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCursor(b *testing.B) {
+	db := openTestDB(b, benchOptions)
+	fillCollection(b, db, "c", 100000)
+
+	tx := db.ReadTx()
+	defer tx.Rollback()
+	c, err := tx.GetCollection([]byte("c"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	cursor := c.Cursor()
+	item, err := cursor.First()
+	for i := 0; i < b.N; i++ {
+		if err != nil {
+			b.Fatal(err)
+		}
+		if item == nil {
+			item, err = cursor.First()
+			continue
+		}
+		item, err = cursor.Next()
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end []byte
+		left       []int
+	}{
+		{"middle", benchKey(100), benchKey(1900), []int{0, 99, 1900, 1999}},
+		{"open start", nil, benchKey(1000), []int{1000, 1999}},
+		{"open end", benchKey(1000), nil, []int{0, 999}},
+		{"everything", nil, nil, nil},
+		{"empty", benchKey(500), benchKey(500), []int{0, 1999}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := openTestDB(t, nil)
+			fillCollection(t, db, "c", 2000)
+			update(t, db, func(tx *Tx) error {
+				c, err := tx.GetCollection([]byte("c"))
+				if err != nil {
+					return err
+				}
+				return c.DeleteRange(test.start, test.end)
+			})
+
+			view(t, db, func(tx *Tx) error {
+				c, err := tx.GetCollection([]byte("c"))
+				if err != nil {
+					return err
+				}
+				keys := collectionKeys(t, c)
+				if test.left == nil {
+					if len(keys) != 0 {
+						t.Errorf("%d keys left, want none", len(keys))
+					}
+					return nil
+				}
+				// left holds the first and last key of each run that stays.
+				var want []string
+				for i := 0; i < len(test.left); i += 2 {
+					for k := test.left[i]; k <= test.left[i+1]; k++ {
+						want = append(want, string(benchKey(k)))
+					}
+				}
+				if fmt.Sprint(keys) != fmt.Sprint(want) {
+					t.Errorf("%d keys left, want %d", len(keys), len(want))
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestDeleteRangeFreesPages(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		_, err := tx.CreateCollection([]byte("c"), nil)
+		return err
+	})
+	before := usedPages(db)
+
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 5000; i++ {
+			if err := c.Put(benchKey(i), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		return c.DeleteRange(nil, nil)
+	})
+	if used := usedPages(db); used != before {
+		t.Errorf("%d pages in use after deleting every key, want %d", used, before)
+	}
+}
+
+func TestDeleteRangeDropsNestedCollections(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		parent, err := tx.CreateCollection([]byte("parent"), nil)
+		if err != nil {
+			return err
+		}
+		_, err = parent.CreateCollection([]byte("child"), nil)
+		return err
+	})
+	update(t, db, func(tx *Tx) error {
+		parent, err := tx.GetCollection([]byte("parent"))
+		if err != nil {
+			return err
+		}
+		child, err := parent.GetCollection([]byte("child"))
+		if err != nil {
+			return err
+		}
+		// The open handle of child must not write its header back.
+		if err := child.SetSequence(7); err != nil {
+			return err
+		}
+		return parent.DeleteRange(nil, nil)
+	})
+
+	view(t, db, func(tx *Tx) error {
+		parent, err := tx.GetCollection([]byte("parent"))
+		if err != nil {
+			return err
+		}
+		child, err := parent.GetCollection([]byte("child"))
+		if err != nil {
+			return err
+		}
+		if child != nil {
+			t.Error("child collection survived DeleteRange")
+		}
+		return nil
+	})
+}
+
+func TestNestedCollections(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDBAt(t, path, nil)
+	update(t, db, func(tx *Tx) error {
+		users, err := tx.CreateCollection([]byte("users"), nil)
+		if err != nil {
+			return err
+		}
+		alice, err := users.CreateCollection([]byte("alice"), nil)
+		if err != nil {
+			return err
+		}
+		if err := alice.Put([]byte("email"), []byte("alice@example.com")); err != nil {
+			return err
+		}
+		if _, err := users.CreateCollection([]byte("alice"), nil); err != collectionExistsErr {
+			t.Errorf("creating alice again returned %v, want %v", err, collectionExistsErr)
+		}
+		if err := users.Put([]byte("alice"), []byte("value")); err != incompatibleValueErr {
+			t.Errorf("putting over a collection returned %v, want %v", err, incompatibleValueErr)
+		}
+		if err := users.Put([]byte("bob"), []byte("value")); err != nil {
+			return err
+		}
+		if _, err := users.CreateCollection([]byte("bob"), nil); err != incompatibleValueErr {
+			t.Errorf("creating a collection over a value returned %v, want %v", err, incompatibleValueErr)
+		}
+		return nil
+	})
+	_ = db.Close()
+
+	db = openTestDBAt(t, path, nil)
+	view(t, db, func(tx *Tx) error {
+		users, err := tx.GetCollection([]byte("users"))
+		if err != nil {
+			return err
+		}
+		alice, err := users.GetCollection([]byte("alice"))
+		if err != nil {
+			return err
+		}
+		if alice == nil {
+			t.Fatal("alice is missing after reopening")
+		}
+		email, err := alice.Get([]byte("email"))
+		if err != nil {
+			return err
+		}
+		if string(email) != "alice@example.com" {
+			t.Errorf("email is %q", email)
+		}
+		if item, err := users.Find([]byte("alice")); err != nil || item != nil {
+			t.Errorf("Find returned %v, %v for a nested collection, want nothing", item, err)
+		}
+		return nil
+	})
+}
+
+func TestItemTooLarge(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), nil)
+		if err != nil {
+			return err
+		}
+		limit := db.maxItemSize() - itemHeaderSize - pageNumberSize
+		if err := c.Put([]byte("k"), make([]byte, limit-1)); err != nil {
+			t.Errorf("putting the largest item returned %v", err)
+		}
+		if err := c.Put([]byte("k"), make([]byte, limit)); err != itemTooLargeErr {
+			t.Errorf("putting an item over the limit returned %v, want %v", err, itemTooLargeErr)
+		}
+		// Items at the limit still leave room to split any node.
+		for i := 0; i < 20; i++ {
+			if err := c.Put(benchKey(i), make([]byte, limit-len(benchKey(i)))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func collectionNames(tb testing.TB, collections iter.Seq2[*Collection, error]) []string {
+	tb.Helper()
+	var names []string
+	for collection, err := range collections {
+		if err != nil {
+			tb.Fatal(err)
+		}
+		names = append(names, string(collection.Name()))
+	}
+	return names
+}
+
+func TestCollectionsAndRename(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		for _, name := range []string{"b", "c", "a"} {
+			c, err := tx.CreateCollection([]byte(name), nil)
+			if err != nil {
+				return err
+			}
+			if err := c.Put([]byte("key"), []byte(name)); err != nil {
+				return err
+			}
+		}
+		a, err := tx.GetCollection([]byte("a"))
+		if err != nil {
+			return err
+		}
+		// Indexes live in internal collections, which aren't listed.
+		_, err = a.CreateIndex([]byte("value"), func(key, value []byte) [][]byte {
+			return [][]byte{value}
+		})
+		return err
+	})
+
+	update(t, db, func(tx *Tx) error {
+		if got := collectionNames(t, tx.Collections()); fmt.Sprint(got) != "[a b c]" {
+			t.Errorf("Collections listed %v, want [a b c]", got)
+		}
+		a, err := tx.GetCollection([]byte("a"))
+		if err != nil {
+			return err
+		}
+		if got := collectionNames(t, a.Collections()); len(got) != 0 {
+			t.Errorf("a lists %v, want no collections", got)
+		}
+
+		if err := tx.RenameCollection([]byte("a"), []byte("d")); err != nil {
+			return err
+		}
+		if err := tx.RenameCollection([]byte("a"), []byte("e")); err != collectionNotFoundErr {
+			t.Errorf("renaming a missing collection returned %v, want %v", err, collectionNotFoundErr)
+		}
+		if err := tx.RenameCollection([]byte("b"), []byte("c")); err != collectionExistsErr {
+			t.Errorf("renaming onto an existing collection returned %v, want %v", err, collectionExistsErr)
+		}
+		return nil
+	})
+
+	update(t, db, func(tx *Tx) error {
+		if got := collectionNames(t, tx.Collections()); fmt.Sprint(got) != "[b c d]" {
+			t.Errorf("Collections listed %v after the rename, want [b c d]", got)
+		}
+		d, err := tx.GetCollection([]byte("d"))
+		if err != nil {
+			return err
+		}
+		if value, err := d.Get([]byte("key")); err != nil || string(value) != "a" {
+			t.Errorf("renamed collection holds %q, %v", value, err)
+		}
+		// The extractor of the index followed the rename.
+		if err := d.Put([]byte("other"), []byte("x")); err != nil {
+			return err
+		}
+		index, err := d.Index([]byte("value"))
+		if err != nil {
+			return err
+		}
+		for item, err := range index.Find([]byte("x")) {
+			if err != nil {
+				return err
+			}
+			if string(item.Key()) != "other" {
+				t.Errorf("index found %q", item.Key())
+			}
+		}
+		return nil
+	})
+}
+
+func TestRenameRolledBack(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("a"), nil)
+		if err != nil {
+			return err
+		}
+		_, err = c.CreateIndex([]byte("value"), func(key, value []byte) [][]byte {
+			return [][]byte{value}
+		})
+		return err
+	})
+
+	tx := db.WriteTx()
+	if err := tx.RenameCollection([]byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+
+	update(t, db, func(tx *Tx) error {
+		if got := collectionNames(t, tx.Collections()); fmt.Sprint(got) != "[a]" {
+			t.Errorf("Collections listed %v, want [a]", got)
+		}
+		c, err := tx.GetCollection([]byte("a"))
+		if err != nil {
+			return err
+		}
+		// Writes fail if the extractor didn't move back.
+		return c.Put([]byte("key"), []byte("value"))
+	})
+}
+
+func TestSequences(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDBAt(t, path, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), nil)
+		if err != nil {
+			return err
+		}
+		child, err := c.CreateCollection([]byte("child"), nil)
+		if err != nil {
+			return err
+		}
+		for i := 1; i <= 3; i++ {
+			if sequence, err := c.NextSequence(); err != nil || sequence != uint64(i) {
+				t.Errorf("NextSequence returned %d, %v, want %d", sequence, err, i)
+			}
+		}
+		// Every handle of a collection shares its sequence.
+		again, err := c.GetCollection([]byte("child"))
+		if err != nil {
+			return err
+		}
+		if err := again.SetSequence(41); err != nil {
+			return err
+		}
+		if sequence, err := child.NextSequence(); err != nil || sequence != 42 {
+			t.Errorf("NextSequence returned %d, %v, want 42", sequence, err)
+		}
+		return nil
+	})
+
+	tx := db.WriteTx()
+	c, err := tx.GetCollection([]byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.NextSequence(); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	_ = db.Close()
+
+	db = openTestDBAt(t, path, nil)
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		if c.Sequence() != 3 {
+			t.Errorf("sequence is %d after reopening, want 3", c.Sequence())
+		}
+		child, err := c.GetCollection([]byte("child"))
+		if err != nil {
+			return err
+		}
+		if child.Sequence() != 42 {
+			t.Errorf("nested sequence is %d after reopening, want 42", child.Sequence())
+		}
+		if _, err := c.NextSequence(); err != writeInsideReadTxErr {
+			t.Errorf("NextSequence in a read transaction returned %v", err)
+		}
+		return nil
+	})
+}
+
+func TestCollectionMeta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDBAt(t, path, nil)
+	var createdAt time.Time
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), &CollectionOptions{
+			MinFillPercent: 0.3,
+			MaxFillPercent: 0.8,
+			Compression:    "snappy",
+			TTL:            time.Hour,
+			Metadata:       []byte("owner=alice"),
+			MaxItems:       10,
+		})
+		if err != nil {
+			return err
+		}
+		createdAt = c.Meta().CreatedAt
+		if createdAt.IsZero() {
+			t.Error("CreatedAt isn't set")
+		}
+		for _, options := range []*CollectionOptions{
+			{MinFillPercent: -0.1},
+			{MaxFillPercent: 1.5},
+			{MinFillPercent: 0.8, MaxFillPercent: 0.5},
+		} {
+			if _, err := tx.CreateCollection([]byte("other"), options); err != invalidFillPercentErr {
+				t.Errorf("creating a collection with %+v returned %v, want %v", *options, err, invalidFillPercentErr)
+			}
+		}
+		return nil
+	})
+	_ = db.Close()
+
+	db = openTestDBAt(t, path, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		meta := c.Meta()
+		if meta.MinFillPercent != 0.3 || meta.MaxFillPercent != 0.8 || meta.Compression != "snappy" {
+			t.Errorf("Meta returned %+v after reopening", meta)
+		}
+		if meta.TTL != time.Hour || string(meta.Metadata) != "owner=alice" || meta.MaxItems != 10 {
+			t.Errorf("Meta returned %+v after reopening", meta)
+		}
+		if !meta.CreatedAt.Equal(createdAt) {
+			t.Errorf("CreatedAt is %v after reopening, want %v", meta.CreatedAt, createdAt)
+		}
+
+		meta.Metadata = []byte("owner=bob")
+		meta.CreatedAt = time.Time{}
+		if err := tx.SetCollectionMeta([]byte("c"), meta); err != nil {
+			return err
+		}
+		bad := meta
+		bad.MaxFillPercent = 0.2
+		if err := tx.SetCollectionMeta([]byte("c"), bad); err != invalidFillPercentErr {
+			t.Errorf("setting a maximum below the minimum returned %v, want %v", err, invalidFillPercentErr)
+		}
+		return nil
+	})
+
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		meta := c.Meta()
+		if string(meta.Metadata) != "owner=bob" || !meta.CreatedAt.Equal(createdAt) {
+			t.Errorf("Meta returned %+v after SetCollectionMeta", meta)
+		}
+		return nil
+	})
+}
+
+func TestConditionalWrites(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), nil)
+		if err != nil {
+			return err
+		}
+		check := func(what string, ok bool, err error, want bool) {
+			t.Helper()
+			if err != nil || ok != want {
+				t.Errorf("%s returned %v, %v, want %v", what, ok, err, want)
+			}
+		}
+
+		ok, err := c.PutIfAbsent([]byte("a"), []byte("1"))
+		check("PutIfAbsent of a new key", ok, err, true)
+		ok, err = c.PutIfAbsent([]byte("a"), []byte("2"))
+		check("PutIfAbsent of an existing key", ok, err, false)
+
+		ok, err = c.CompareAndSwap([]byte("a"), []byte("2"), []byte("3"))
+		check("CompareAndSwap from the wrong value", ok, err, false)
+		ok, err = c.CompareAndSwap([]byte("a"), []byte("1"), []byte("3"))
+		check("CompareAndSwap from the right value", ok, err, true)
+		ok, err = c.CompareAndSwap([]byte("missing"), nil, []byte("3"))
+		check("CompareAndSwap of a missing key", ok, err, false)
+
+		ok, err = c.DeleteIfEquals([]byte("a"), []byte("1"))
+		check("DeleteIfEquals of the wrong value", ok, err, false)
+		ok, err = c.DeleteIfEquals([]byte("a"), []byte("3"))
+		check("DeleteIfEquals of the right value", ok, err, true)
+		if value, err := c.Get([]byte("a")); err != nil || value != nil {
+			t.Errorf("a holds %q, %v after DeleteIfEquals", value, err)
+		}
+
+		// An expired key counts as absent.
+		if err := c.PutWithTTL([]byte("b"), []byte("1"), time.Millisecond); err != nil {
+			return err
+		}
+		time.Sleep(2 * time.Millisecond)
+		ok, err = c.CompareAndSwap([]byte("b"), []byte("1"), []byte("2"))
+		check("CompareAndSwap of an expired key", ok, err, false)
+		ok, err = c.PutIfAbsent([]byte("b"), []byte("2"))
+		check("PutIfAbsent of an expired key", ok, err, true)
+
+		// Nested collections are never matched.
+		if _, err := c.CreateCollection([]byte("child"), nil); err != nil {
+			return err
+		}
+		ok, err = c.DeleteIfEquals([]byte("child"), nil)
+		check("DeleteIfEquals of a collection", ok, err, false)
+		return nil
+	})
+
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		if _, err := c.PutIfAbsent([]byte("c"), nil); err != writeInsideReadTxErr {
+			t.Errorf("PutIfAbsent in a read transaction returned %v", err)
+		}
+		return nil
+	})
+}
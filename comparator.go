@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+// Comparator orders the keys of a collection. It returns a negative number
+// when a sorts before b, zero when they are the same key and a positive
+// number otherwise.
+type Comparator func(a, b []byte) int
+
+var unknownComparatorErr = errors.New("comparator is not registered")
+
+var (
+	comparatorsLock sync.RWMutex
+	comparators     = map[string]Comparator{}
+)
+
+// RegisterComparator makes a comparator available to CollectionOptions
+// under name. A collection created with it records the name and can only be
+// opened again once a comparator has been registered under the same name.
+func RegisterComparator(name string, comparator Comparator) {
+	comparatorsLock.Lock()
+	defer comparatorsLock.Unlock()
+	comparators[name] = comparator
+}
+
+func getComparator(name string) (Comparator, error) {
+	if name == "" {
+		return bytes.Compare, nil
+	}
+
+	comparatorsLock.RLock()
+	defer comparatorsLock.RUnlock()
+	comparator, ok := comparators[name]
+	if !ok {
+		return nil, unknownComparatorErr
+	}
+	return comparator, nil
+}
+
+// countComparator records that a collection created with the comparator
+// name was added, or dropped for a negative delta.
+func (tx *Tx) countComparator(name string, delta int) {
+	if name == "" {
+		return
+	}
+	if tx.comparators == nil {
+		tx.comparators = map[string]int{}
+	}
+	tx.comparators[name] += delta
+}
+
+// countComparators applies the changes a transaction made to the number of
+// collections created with each comparator.
+func (m *meta) countComparators(deltas map[string]int) {
+	for name, delta := range deltas {
+		count := int64(m.comparators[name]) + int64(delta)
+		if count <= 0 {
+			delete(m.comparators, name)
+		} else {
+			m.comparators[name] = uint64(count)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func reverseCompare(a, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+func TestCustomComparator(t *testing.T) {
+	RegisterComparator("test-reverse", reverseCompare)
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), &CollectionOptions{Comparator: "test-reverse"})
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := c.Put(benchKey(i), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		keys := collectionKeys(t, c)
+		if len(keys) != 1000 || keys[0] != string(benchKey(999)) || keys[999] != string(benchKey(0)) {
+			t.Errorf("%d keys from %q to %q, want 1000 in reverse order", len(keys), keys[0], keys[len(keys)-1])
+		}
+		if item, err := c.Find(benchKey(500)); err != nil || item == nil {
+			t.Errorf("Find returned %v, %v", item, err)
+		}
+		// Ranges follow the order of the comparator too.
+		if err := c.DeleteRange(benchKey(900), benchKey(100)); err != nil {
+			return err
+		}
+		keys = collectionKeys(t, c)
+		if len(keys) != 200 {
+			t.Errorf("%d keys left after DeleteRange, want 200", len(keys))
+		}
+
+		meta := c.Meta()
+		meta.Comparator = ""
+		if err := tx.SetCollectionMeta([]byte("c"), meta); err != comparatorChangeErr {
+			t.Errorf("changing the comparator returned %v, want %v", err, comparatorChangeErr)
+		}
+		return nil
+	})
+}
+
+func TestOpenNeedsComparators(t *testing.T) {
+	deleteCollection := func(tx *Tx) error { return tx.DeleteCollection([]byte("c")) }
+	tests := []struct {
+		name     string
+		nested   bool
+		drop     func(tx *Tx) error
+		rollback bool
+		want     error
+	}{
+		{"top-level", false, nil, false, unknownComparatorErr},
+		{"nested", true, nil, false, unknownComparatorErr},
+		{"deleted", false, deleteCollection, false, nil},
+		{"deleted with its parent", true, deleteCollection, false, nil},
+		{"rolled back", false, nil, true, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := fmt.Sprintf("test-unregistered-%s", test.name)
+			RegisterComparator(name, reverseCompare)
+			path := filepath.Join(t.TempDir(), "test.db")
+			db := openTestDBAt(t, path, nil)
+			tx := db.WriteTx()
+			collectionOptions := &CollectionOptions{Comparator: name}
+			var err error
+			if test.nested {
+				var c *Collection
+				if c, err = tx.CreateCollection([]byte("c"), nil); err == nil {
+					_, err = c.CreateCollection([]byte("child"), collectionOptions)
+				}
+			} else {
+				_, err = tx.CreateCollection([]byte("c"), collectionOptions)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.drop != nil {
+				if err := test.drop(tx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.rollback {
+				tx.Rollback()
+			} else if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			_ = db.Close()
+
+			comparatorsLock.Lock()
+			delete(comparators, name)
+			comparatorsLock.Unlock()
+
+			options := *DefaultOptions
+			options.ReapInterval = 0
+			db, err = Open(path, &options)
+			if err == nil {
+				_ = db.Close()
+			}
+			if err != test.want {
+				t.Errorf("Open returned %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestOpenCountsComparatorsOnce(t *testing.T) {
+	RegisterComparator("test-reverse", reverseCompare)
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDBAt(t, path, nil)
+	fillCollection(t, db, "plain", 10000)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), nil)
+		if err != nil {
+			return err
+		}
+		_, err = c.CreateCollection([]byte("child"), &CollectionOptions{Comparator: "test-reverse"})
+		return err
+	})
+	_ = db.Close()
+
+	// Open reads the counts, not the collections.
+	db = openTestDBAt(t, path, nil)
+	if stats := db.CacheStats(); stats.Hits+stats.Misses != 0 {
+		t.Errorf("Open read %d nodes", stats.Hits+stats.Misses)
+	}
+
+	// A file from before the counts were kept is counted on open.
+	db.rwlock.Lock()
+	db.comparators = nil
+	_, err := db.writeMeta(db.meta)
+	db.rwlock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Close()
+	db = openTestDBAt(t, path, nil)
+	if fmt.Sprint(db.comparators) != "map[test-reverse:1]" {
+		t.Errorf("counted %v", db.comparators)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+type elementRef struct {
+	node  *Node
+	index int
+}
+
+// Cursor walks the items of a collection in key order. The frames on the
+// stack below the top hold the index of the child that was descended into;
+// the top frame holds the index of the current item. Nested collections
+// show up as items without a value, for which IsCollection is true.
+//
+// A cursor stays valid when the collection is modified through the same
+// transaction: it remembers the key it is on and, once the transaction has
+// touched any node since the cursor last moved, re-seeks from that key
+// instead of trusting its stack.
+type Cursor struct {
+	collection *Collection
+	stack      []elementRef
+	key        []byte
+	mutations  uint64
+}
+
+func (c *Collection) Cursor() *Cursor {
+	return &Cursor{
+		collection: c,
+	}
+}
+
+func (cur *Cursor) First() (*Item, error) {
+	return cur.skip(cur.first, cur.next)
+}
+
+func (cur *Cursor) Last() (*Item, error) {
+	return cur.skip(cur.last, cur.prev)
+}
+
+func (cur *Cursor) Seek(key []byte) (*Item, error) {
+	return cur.skip(func() (*Item, error) { return cur.seek(key) }, cur.next)
+}
+
+func (cur *Cursor) Next() (*Item, error) {
+	return cur.skip(cur.next, cur.next)
+}
+
+func (cur *Cursor) Prev() (*Item, error) {
+	return cur.skip(cur.prev, cur.prev)
+}
+
+// skip positions the cursor and then keeps stepping until it rests on an
+// item that hasn't expired.
+func (cur *Cursor) skip(position, step func() (*Item, error)) (*Item, error) {
+	item, err := position()
+	for err == nil && item != nil {
+		if visible := cur.collection.visible(item); visible != nil {
+			return visible, nil
+		}
+		item, err = step()
+	}
+	return item, err
+}
+
+func (cur *Cursor) first() (*Item, error) {
+	cur.stack = cur.stack[:0]
+	if err := cur.descendFirst(cur.collection.root); err != nil {
+		return nil, err
+	}
+	return cur.settleForward(), nil
+}
+
+func (cur *Cursor) last() (*Item, error) {
+	cur.stack = cur.stack[:0]
+	if err := cur.descendLast(cur.collection.root); err != nil {
+		return nil, err
+	}
+	return cur.settleBackward(), nil
+}
+
+func (cur *Cursor) seek(key []byte) (*Item, error) {
+	cur.stack = cur.stack[:0]
+	pageNum := cur.collection.root
+	for {
+		node, err := cur.collection.tx.readNode(pageNum)
+		if err != nil {
+			return nil, err
+		}
+		wasFound, index := node.findKeyInNode(key, cur.collection.compare)
+		cur.stack = append(cur.stack, elementRef{node, index})
+		if wasFound || node.isLeaf() {
+			return cur.settleForward(), nil
+		}
+		pageNum = node.childNodes[index]
+	}
+}
+
+func (cur *Cursor) next() (*Item, error) {
+	if cur.stale() {
+		key := cur.key
+		item, err := cur.seek(key)
+		if err != nil || item == nil || cur.collection.compare(item.key, key) != 0 {
+			return item, err
+		}
+	}
+	if len(cur.stack) == 0 {
+		return nil, nil
+	}
+
+	top := &cur.stack[len(cur.stack)-1]
+	top.index++
+	if !top.node.isLeaf() {
+		if err := cur.descendFirst(top.node.childNodes[top.index]); err != nil {
+			return nil, err
+		}
+	}
+	return cur.settleForward(), nil
+}
+
+func (cur *Cursor) prev() (*Item, error) {
+	if cur.stale() {
+		item, err := cur.seek(cur.key)
+		if err != nil {
+			return nil, err
+		}
+		if item == nil {
+			return cur.last()
+		}
+	}
+	if len(cur.stack) == 0 {
+		return nil, nil
+	}
+
+	top := &cur.stack[len(cur.stack)-1]
+	if top.node.isLeaf() {
+		top.index--
+	} else if err := cur.descendLast(top.node.childNodes[top.index]); err != nil {
+		return nil, err
+	}
+	return cur.settleBackward(), nil
+}
+
+// Delete removes the item the cursor is on. The following Next or Prev
+// returns the neighbour of the removed key.
+func (cur *Cursor) Delete() error {
+	if cur.key == nil {
+		return nil
+	}
+	return cur.collection.Remove(cur.key)
+}
+
+// Update replaces the value of the item the cursor is on. The item keeps its
+// expiry time.
+func (cur *Cursor) Update(value []byte) error {
+	if cur.key == nil {
+		return nil
+	}
+	_, err := cur.collection.rewrite(cur.key, func(*Item) ([]byte, bool, error) {
+		return value, true, nil
+	})
+	return err
+}
+
+func (cur *Cursor) stale() bool {
+	return cur.key != nil && cur.mutations != cur.collection.tx.mutations
+}
+
+func (cur *Cursor) descendFirst(pageNum pageNumber) error {
+	for {
+		node, err := cur.collection.tx.readNode(pageNum)
+		if err != nil {
+			return err
+		}
+		cur.stack = append(cur.stack, elementRef{node, 0})
+		if node.isLeaf() {
+			return nil
+		}
+		pageNum = node.childNodes[0]
+	}
+}
+
+func (cur *Cursor) descendLast(pageNum pageNumber) error {
+	for {
+		node, err := cur.collection.tx.readNode(pageNum)
+		if err != nil {
+			return err
+		}
+		if node.isLeaf() {
+			cur.stack = append(cur.stack, elementRef{node, len(node.items) - 1})
+			return nil
+		}
+		cur.stack = append(cur.stack, elementRef{node, len(node.childNodes) - 1})
+		pageNum = node.childNodes[len(node.childNodes)-1]
+	}
+}
+
+func (cur *Cursor) settleForward() *Item {
+	for len(cur.stack) > 0 {
+		top := cur.stack[len(cur.stack)-1]
+		if top.index < len(top.node.items) {
+			return cur.current()
+		}
+		cur.stack = cur.stack[:len(cur.stack)-1]
+	}
+	return cur.current()
+}
+
+func (cur *Cursor) settleBackward() *Item {
+	for len(cur.stack) > 0 {
+		top := cur.stack[len(cur.stack)-1]
+		if top.index >= 0 && top.index < len(top.node.items) {
+			return cur.current()
+		}
+		cur.stack = cur.stack[:len(cur.stack)-1]
+		if len(cur.stack) > 0 {
+			cur.stack[len(cur.stack)-1].index--
+		}
+	}
+	return cur.current()
+}
+
+func (cur *Cursor) current() *Item {
+	cur.mutations = cur.collection.tx.mutations
+	if len(cur.stack) == 0 {
+		cur.key = nil
+		return nil
+	}
+	top := cur.stack[len(cur.stack)-1]
+	item := top.node.items[top.index]
+	cur.key = item.key
+	return item
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCursorWalk(t *testing.T) {
+	db := openTestDB(t, nil)
+	fillCollection(t, db, "c", 1000)
+
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		cursor := c.Cursor()
+		count := 0
+		item, err := cursor.Last()
+		for ; item != nil; item, err = cursor.Prev() {
+			if want := benchKey(999 - count); string(item.Key()) != string(want) {
+				t.Fatalf("Prev returned %q, want %q", item.Key(), want)
+			}
+			count++
+		}
+		if err != nil {
+			return err
+		}
+		if count != 1000 {
+			t.Errorf("walked back over %d keys, want 1000", count)
+		}
+
+		item, err = cursor.Seek([]byte("key00000499x"))
+		if err != nil {
+			return err
+		}
+		if item == nil || string(item.Key()) != string(benchKey(500)) {
+			t.Errorf("Seek between keys returned %v, want %q", item, benchKey(500))
+		}
+		item, err = cursor.Seek([]byte("z"))
+		if err != nil {
+			return err
+		}
+		if item != nil {
+			t.Errorf("Seek past the last key returned %q", item.Key())
+		}
+		return nil
+	})
+}
+
+func TestCursorDeleteWhileWalking(t *testing.T) {
+	db := openTestDB(t, nil)
+	fillCollection(t, db, "c", 1000)
+
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		cursor := c.Cursor()
+		i := 0
+		item, err := cursor.First()
+		for ; item != nil; item, err = cursor.Next() {
+			if want := benchKey(i); string(item.Key()) != string(want) {
+				return fmt.Errorf("Next returned %q, want %q", item.Key(), want)
+			}
+			if i%2 == 0 {
+				if err := cursor.Delete(); err != nil {
+					return err
+				}
+			}
+			i++
+		}
+		if err != nil {
+			return err
+		}
+		if i != 1000 {
+			t.Errorf("visited %d keys, want 1000", i)
+		}
+		return nil
+	})
+
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		keys := collectionKeys(t, c)
+		if len(keys) != 500 || keys[0] != string(benchKey(1)) {
+			t.Errorf("%d keys left starting at %q, want the 500 odd ones", len(keys), keys[0])
+		}
+		return nil
+	})
+}
+
+func TestCursorSeesWritesOfItsTransaction(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), nil)
+		if err != nil {
+			return err
+		}
+		for _, key := range []string{"a", "c", "e"} {
+			if err := c.Put([]byte(key), []byte(key)); err != nil {
+				return err
+			}
+		}
+
+		cursor := c.Cursor()
+		item, err := cursor.First()
+		if err != nil {
+			return err
+		}
+		// Inserting ahead of the cursor and updating under it must not
+		// throw it off its key.
+		if err := c.Put([]byte("b"), []byte("b")); err != nil {
+			return err
+		}
+		if err := cursor.Update([]byte("A")); err != nil {
+			return err
+		}
+		var got []string
+		for ; item != nil; item, err = cursor.Next() {
+			value, err := c.Get(item.Key())
+			if err != nil {
+				return err
+			}
+			got = append(got, string(item.Key())+"="+string(value))
+			if string(item.Key()) == "c" {
+				if err := c.Put([]byte("d"), []byte("d")); err != nil {
+					return err
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if want := "[a=A b=b c=c d=d e=e]"; fmt.Sprint(got) != want {
+			t.Errorf("walked over %v, want %v", got, want)
+		}
+		return nil
+	})
+}
+
+func TestCursorShowsCollectionsWithoutValues(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mmap=%v", mmap), func(t *testing.T) {
+			db := openTestDB(t, func(options *Options) {
+				options.MMap = mmap
+			})
+			update(t, db, func(tx *Tx) error {
+				c, err := tx.CreateCollection([]byte("c"), nil)
+				if err != nil {
+					return err
+				}
+				if _, err := c.CreateCollection([]byte("child"), nil); err != nil {
+					return err
+				}
+				return c.Put([]byte("key"), []byte("value"))
+			})
+
+			view(t, db, func(tx *Tx) error {
+				c, err := tx.GetCollection([]byte("c"))
+				if err != nil {
+					return err
+				}
+				var got []string
+				cursor := c.Cursor()
+				item, err := cursor.First()
+				for ; item != nil; item, err = cursor.Next() {
+					got = append(got, fmt.Sprintf("%s:%q:%v", item.Key(), item.Value(), item.IsCollection()))
+				}
+				if err != nil {
+					return err
+				}
+				if want := `[child:"":true key:"value":false]`; fmt.Sprint(got) != want {
+					t.Errorf("the cursor returned %v, want %s", got, want)
+				}
+				return nil
+			})
+		})
+	}
+}
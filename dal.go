@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"time"
 )
 
 type pageNumber uint64
@@ -12,11 +13,33 @@ type Options struct {
 	pageSize       int
 	MinFillPercent float32
 	MaxFillPercent float32
+
+	// ReapInterval is how often expired items are deleted; zero disables
+	// the reaper. ReapBatchSize bounds the items deleted per transaction.
+	ReapInterval  time.Duration
+	ReapBatchSize int
+
+	// CacheSize is the number of nodes kept decoded in memory; zero
+	// disables the cache.
+	CacheSize int
+
+	// MMap reads pages straight from a read-only mapping of the file
+	// instead of copying them. Writes still go through the file. It has no
+	// effect where mmap isn't available.
+	MMap bool
+
+	// BulkFillPercent is how full BulkLoad packs nodes, as a fraction of
+	// MaxFillPercent, leaving room for later writes; zero means 0.9.
+	BulkFillPercent float32
 }
 
 var DefaultOptions = &Options{
-	MinFillPercent: 0.5,
-	MaxFillPercent: 0.95,
+	MinFillPercent:  0.5,
+	MaxFillPercent:  0.95,
+	ReapInterval:    time.Minute,
+	ReapBatchSize:   100,
+	CacheSize:       1024,
+	BulkFillPercent: 0.9,
 }
 
 type page struct {
@@ -25,20 +48,35 @@ type page struct {
 }
 
 type dal struct {
-	file           *os.File
-	pageSize       int
-	minFillPercent float32
-	maxFillPercent float32
+	file            *os.File
+	pageSize        int
+	minFillPercent  float32
+	maxFillPercent  float32
+	bulkFillPercent float32
+	cache           *nodeCache
+
+	// mmap is set when pages are read from data, a mapping of the file.
+	// Pages the file has grown by since it was mapped are read from the
+	// file until the next remap.
+	mmap bool
+	data []byte
+
 	*freeList
 	*meta
 }
 
 func newDal(path string, options *Options) (*dal, error) {
 	dal := &dal{
-		meta:           newMeta(),
-		pageSize:       options.pageSize,
-		minFillPercent: options.MinFillPercent,
-		maxFillPercent: options.MaxFillPercent,
+		meta:            newMeta(),
+		pageSize:        options.pageSize,
+		minFillPercent:  options.MinFillPercent,
+		maxFillPercent:  options.MaxFillPercent,
+		bulkFillPercent: options.BulkFillPercent,
+		cache:           newNodeCache(options.CacheSize),
+		mmap:            options.MMap,
+	}
+	if dal.bulkFillPercent == 0 {
+		dal.bulkFillPercent = 0.9
 	}
 
 	if _, err := os.Stat(path); err == nil {
@@ -50,6 +88,7 @@ func newDal(path string, options *Options) (*dal, error) {
 
 		meta, err := dal.readMeta()
 		if err != nil {
+			_ = dal.close()
 			return nil, err
 		}
 		dal.meta = meta
@@ -80,13 +119,26 @@ func newDal(path string, options *Options) (*dal, error) {
 		dal.root = collectionsNode.pageNum
 
 		_, err = dal.writeMeta(dal.meta) 
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		return nil, err
 	}
+	if err := dal.remap(); err != nil {
+		_ = dal.close()
+		return nil, err
+	}
 	return dal, nil
 }
 
 func (d *dal) close() error {
+	if d.data != nil {
+		if err := munmap(d.data); err != nil {
+			return fmt.Errorf("could not unmap file: %s", err)
+		}
+		d.data = nil
+	}
 	if d.file != nil {
 		if err := d.file.Close(); err != nil {
 			return fmt.Errorf("could not close file: %s", err)
@@ -103,9 +155,43 @@ func (d *dal) allocateEmptyPage() *page {
 	}
 }
 
+// remap maps the file again once it has grown past the mapping. The nodes
+// in the cache may point into the old mapping, so they are dropped. It must
+// only run while no transaction is open, or with the write lock held at
+// the end of a commit, since readers keep slices of the mapping.
+func (d *dal) remap() error {
+	if !d.mmap {
+		return nil
+	}
+	info, err := d.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := int(info.Size())
+	if size <= len(d.data) {
+		return nil
+	}
+
+	if d.data != nil {
+		if err := munmap(d.data); err != nil {
+			return err
+		}
+		d.data = nil
+	}
+	d.cache.clear()
+	d.data, err = mmapFile(d.file, size)
+	return err
+}
+
+// readPage returns the page straight from the mapping when the file is
+// mapped; its data must not be changed then.
 func (d *dal) readPage(number pageNumber) (*page, error) {
-	page := d.allocateEmptyPage()
 	offset := d.pageSize * int(number)
+	if offset+d.pageSize <= len(d.data) {
+		return &page{data: d.data[offset : offset+d.pageSize]}, nil
+	}
+
+	page := d.allocateEmptyPage()
 	_, err := d.file.ReadAt(page.data, int64(offset))
 	if err != nil {
 		return nil, fmt.Errorf("error when reading page: %s", err)
@@ -114,6 +200,7 @@ func (d *dal) readPage(number pageNumber) (*page, error) {
 }
 
 func (d *dal) writePage(page *page) error {
+	d.cache.invalidate(page.number)
 	offset := int64(page.number) * int64(d.pageSize)
 	_, err := d.file.WriteAt(page.data, offset)
 	return err
@@ -136,30 +223,50 @@ func (d *dal) readMeta() (*meta, error) {
 		return nil, err
 	}
 	meta := newMeta()
-	meta.deserialize(page.data)
+	if err := meta.deserialize(page.data); err != nil {
+		return nil, err
+	}
 	return meta, nil
 }
 
+// writeFreeList writes the freelist to its chain of pages. The chain pages
+// of the list being replaced are free once it is written, so they are
+// listed as released in it.
 func (d *dal) writeFreeList() (*page, error) {
-	page := d.allocateEmptyPage()
-	page.number = d.freeListPage
-	d.freeList.serialize(page.data)
-	err := d.writePage(page)
-	if err != nil {
-		return nil, err
+	d.freeList.releasedPages = append(d.freeList.releasedPages, d.freeList.chainPages...)
+	d.freeList.chainPages = nil
+	extraPages := d.freeList.extraPages(d.pageSize)
+	pages := []*page{d.allocateEmptyPage()}
+	pages[0].number = d.freeListPage
+	for _, number := range extraPages {
+		p := d.allocateEmptyPage()
+		p.number = number
+		pages = append(pages, p)
 	}
-	d.freeListPage = page.number
-	return page, nil
-}
 
-func (d *dal) readFreelist() (*freeList, error) {
-	p, err := d.readPage(d.freeListPage)
-	if err != nil {
-		return nil, err
+	d.freeList.serialize(pages)
+	for _, p := range pages {
+		if err := d.writePage(p); err != nil {
+			return nil, err
+		}
 	}
+	d.freeList.chainPages = extraPages
+	return pages[0], nil
+}
 
+func (d *dal) readFreelist() (*freeList, error) {
 	freeList := newFreeList()
-	freeList.deserialize(p.data)
+	number := d.freeListPage
+	for first := true; number != 0; first = false {
+		p, err := d.readPage(number)
+		if err != nil {
+			return nil, err
+		}
+		if !first {
+			freeList.chainPages = append(freeList.chainPages, number)
+		}
+		number = freeList.deserialize(p.data, first)
+	}
 	return freeList, nil
 }
 
@@ -167,33 +274,82 @@ func (d *dal) readFreelist() (*freeList, error) {
 
 
 func (d *dal) getNode(pageNum pageNumber) (*Node, error) {
+	node, cached, err := d.readNodeShared(pageNum)
+	if err != nil || !cached {
+		return node, err
+	}
+	return copyNode(node), nil
+}
+
+// readNode returns the cached node itself rather than a copy, for callers
+// that don't change it.
+func (d *dal) readNode(pageNum pageNumber) (*Node, error) {
+	node, _, err := d.readNodeShared(pageNum)
+	return node, err
+}
+
+// readNodeShared returns the node on pageNum and whether it is shared with
+// the cache.
+func (d *dal) readNodeShared(pageNum pageNumber) (*Node, bool, error) {
+	if node, ok := d.cache.get(pageNum); ok {
+		return node, true, nil
+	}
 	p, err := d.readPage(pageNum)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	node := NewNode()
 	node.deserialize(p.data)
 	node.pageNum = pageNum
-	return node, nil
+	if d.cache == nil {
+		return node, false, nil
+	}
+	d.cache.add(node)
+	return node, true, nil
 }
 
 func (d *dal) writeNode(n *Node) (*Node, error) {
-	p := d.allocateEmptyPage()
-	if n.pageNum == 0 {
-		p.number = d.getNextPage()
-		n.pageNum = p.number
-	} else {
-		p.number = n.pageNum
-	}
-	p.data = n.serialize(p.data)
-	if err := d.writePage(p); err != nil {
+	if err := d.writeNodes([]*Node{n}); err != nil {
 		return nil, err
 	}
 	return n, nil
+}
 
+// writeNodes serializes every node before writing any of them. With the
+// file mapped, an item that moved between nodes still points into the page
+// it was read from, which may be one of those being written.
+func (d *dal) writeNodes(nodes []*Node) error {
+	pages := make([]*page, 0, len(nodes))
+	for _, n := range nodes {
+		p := d.allocateEmptyPage()
+		if n.pageNum == 0 {
+			p.number = d.getNextPage()
+			n.pageNum = p.number
+		} else {
+			p.number = n.pageNum
+		}
+		p.data = n.serialize(p.data)
+		pages = append(pages, p)
+	}
+
+	for _, p := range pages {
+		if err := d.writePage(p); err != nil {
+			return err
+		}
+		// The cached copy is decoded from the page just written, so it
+		// doesn't share the items of the node.
+		if d.cache != nil {
+			node := NewNode()
+			node.deserialize(p.data)
+			node.pageNum = p.number
+			d.cache.add(node)
+		}
+	}
+	return nil
 }
 
 func (d *dal) deleteNode(number pageNumber) {
+	d.cache.invalidate(number)
 	d.releasePage(number)
 }
 
@@ -201,10 +357,22 @@ func (d *dal) maxThreshold() float32 {
 	return d.maxFillPercent * float32(d.pageSize)
 }
 
+// maxItemSize is the most room an item may take up in a node. Any two items
+// fit in a node without overpopulating it, so a node that has to be split
+// always holds at least three.
+func (d *dal) maxItemSize() int {
+	return (int(d.maxThreshold()) - nodeHeaderSize - pageNumberSize) / 2
+}
+
 func (d *dal) isOverPopulated(node *Node) bool {
 	return float32(node.nodeSize()) > d.maxThreshold()
 }
 
+// bulkThreshold is the size BulkLoad fills nodes to.
+func (d *dal) bulkThreshold() float32 {
+	return d.bulkFillPercent * d.maxThreshold()
+}
+
 func (d *dal) minThreshold() float32 {
 	return d.minFillPercent * float32(d.pageSize)
 }
@@ -217,10 +385,13 @@ func (d *dal) getSplitIndex(node *Node) int {
 	size := 0
 	size += nodeHeaderSize
 
+	if len(node.items) < 3 {
+		return -1
+	}
 	for i := range node.items {
 		size += node.elementSize(i)
 		if float32(size) > d.minThreshold() && i < len(node.items) - 1 {
-			return i + 1
+			return min(i + 1, len(node.items) - 2)
 		}
 	}
 
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"unsafe"
+)
+
+func mmapOptions(options *Options) {
+	options.MMap = true
+}
+
+// largeValue is a value of about a quarter page, made of key.
+func largeValue(db *DB, key []byte) []byte {
+	return bytes.Repeat(key, db.pageSize/4/len(key))
+}
+
+// grow writes count keys of a large value to c in one transaction,
+// so the file outgrows its mapping.
+func grow(tb testing.TB, db *DB, round, count int) {
+	tb.Helper()
+	update(tb, db, func(tx *Tx) error {
+		c, err := tx.CreateCollectionIfNotExists([]byte("c"), nil)
+		if err != nil {
+			return err
+		}
+		for i := range count {
+			key := fmt.Appendf(nil, "%d-%06d", round, i)
+			if err := c.Put(key, largeValue(db, key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func TestMMapReadsAfterTheFileGrows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDBAt(t, path, mmapOptions)
+	check := func(db *DB, rounds int) {
+		t.Helper()
+		view(t, db, func(tx *Tx) error {
+			c, err := tx.GetCollection([]byte("c"))
+			if err != nil {
+				return err
+			}
+			for round := range rounds {
+				for i := range 500 {
+					key := fmt.Appendf(nil, "%d-%06d", round, i)
+					value, err := c.Get(key)
+					if err != nil {
+						return err
+					}
+					if !bytes.Equal(value, largeValue(db, key)) {
+						t.Fatalf("%s has %q", key, value)
+					}
+				}
+			}
+			return nil
+		})
+	}
+
+	mapped := len(db.data)
+	for round := range 4 {
+		grow(t, db, round, 500)
+		if len(db.data) <= mapped {
+			t.Fatalf("the mapping stayed at %d bytes after round %d", mapped, round)
+		}
+		mapped = len(db.data)
+		check(db, round+1)
+	}
+
+	// Pages inside the mapping are read from it, not copied.
+	p, err := db.readPage(db.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := uintptr(unsafe.Pointer(&db.data[0]))
+	if at := uintptr(unsafe.Pointer(&p.data[0])); at < start || at >= start+uintptr(len(db.data)) {
+		t.Error("the root page was copied out of the mapping")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(openTestDBAt(t, path, mmapOptions), 4)
+}
+
+func TestNamesOutliveTheMapping(t *testing.T) {
+	db := openTestDB(t, mmapOptions)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("people"), &CollectionOptions{Metadata: []byte("metadata")})
+		if err != nil {
+			return err
+		}
+		if _, err := c.CreateIndex([]byte("city"), byCity); err != nil {
+			return err
+		}
+		return c.Put([]byte("ada"), []byte("ada:london"))
+	})
+
+	var name, metadata, index []byte
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("people"))
+		if err != nil {
+			return err
+		}
+		idx, err := c.Index([]byte("city"))
+		if err != nil {
+			return err
+		}
+		name, metadata, index = c.Name(), c.Meta().Metadata, idx.Name()
+		return nil
+	})
+
+	// Remapping unmaps the pages they were read from.
+	mapped := len(db.data)
+	grow(t, db, 0, 1000)
+	if len(db.data) <= mapped {
+		t.Fatal("the file wasn't remapped")
+	}
+	if string(name) != "people" || string(metadata) != "metadata" || string(index) != "city" {
+		t.Errorf("the names are %q, %q and %q after remapping", name, metadata, index)
+	}
+}
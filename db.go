@@ -8,6 +8,15 @@ import (
 type DB struct {
 	rwlock sync.RWMutex
 	*dal
+
+	stopReaper chan struct{}
+	reaperDone chan struct{}
+
+	// extractors holds the index extractors registered by CreateIndex.
+	// Read transactions register them too, so they are guarded by their
+	// own lock rather than rwlock.
+	extractorsLock sync.RWMutex
+	extractors     map[string]IndexExtractor
 }
 
 
@@ -20,15 +29,69 @@ func Open(path string, options *Options) (*DB, error){
 		return nil,err
 	}
 	db:=&DB{
-		sync.RWMutex{},
-		dal,
+		rwlock: sync.RWMutex{},
+		dal:    dal,
 	}
 
+	if err := db.checkComparators(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if options.ReapInterval > 0 {
+		db.startReaper(options.ReapInterval, options.ReapBatchSize)
+	}
 	return db, nil
 }
 
+// checkComparators refuses files with a collection, at any depth, that was
+// created with a comparator that has not been registered. The meta page
+// counts the collections of each comparator; a file written before it did
+// is walked once to count them.
+func (db *DB) checkComparators() error {
+	if db.comparators == nil {
+		if err := db.recountComparators(); err != nil {
+			return err
+		}
+	}
+	for name := range db.comparators {
+		if _, err := getComparator(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recountComparators walks every collection to count those created with
+// each comparator and records the counts in the meta page. Opening a
+// collection whose comparator isn't registered fails.
+func (db *DB) recountComparators() error {
+	tx := db.WriteTx()
+	defer tx.Rollback()
+	if err := countNestedComparators(tx, tx.getRootCollection()); err != nil {
+		return err
+	}
+	db.comparators = map[string]uint64{}
+	db.countComparators(tx.comparators)
+	_, err := db.writeMeta(db.meta)
+	return err
+}
+
+func countNestedComparators(tx *Tx, c *Collection) error {
+	for collection, err := range c.Collections() {
+		if err != nil {
+			return err
+		}
+		tx.countComparator(collection.meta.Comparator, 1)
+		if err := countNestedComparators(tx, collection); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 
 func (db *DB) Close() error {
+	db.stopReaping()
 	return db.close()
 }
 
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// openTestDB opens a new database in a temporary directory, with the reaper
+// off unless configure turns it on, and closes it at the end of the test.
+func openTestDB(tb testing.TB, configure func(*Options)) *DB {
+	tb.Helper()
+	return openTestDBAt(tb, filepath.Join(tb.TempDir(), "test.db"), configure)
+}
+
+// openTestDBAt is openTestDB for a file that may already exist.
+func openTestDBAt(tb testing.TB, path string, configure func(*Options)) *DB {
+	tb.Helper()
+	options := *DefaultOptions
+	options.ReapInterval = 0
+	if configure != nil {
+		configure(&options)
+	}
+	db, err := Open(path, &options)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// update runs fn in a write transaction and commits it. The transaction is
+// rolled back if fn fails the test, so the database can still be closed.
+func update(tb testing.TB, db *DB, fn func(tx *Tx) error) {
+	tb.Helper()
+	tx := db.WriteTx()
+	defer func() {
+		if !tx.closed {
+			tx.Rollback()
+		}
+	}()
+	if err := fn(tx); err != nil {
+		tb.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// view runs fn in a read transaction.
+func view(tb testing.TB, db *DB, fn func(tx *Tx) error) {
+	tb.Helper()
+	tx := db.ReadTx()
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// usedPages is the number of pages of the file that hold something.
+func usedPages(db *DB) int {
+	return int(db.maxPage) - len(db.releasedPages) - len(db.chainPages)
+}
+
+// collectionKeys returns the keys of c in cursor order.
+func collectionKeys(tb testing.TB, c *Collection) []string {
+	tb.Helper()
+	var keys []string
+	cursor := c.Cursor()
+	item, err := cursor.First()
+	for ; item != nil; item, err = cursor.Next() {
+		keys = append(keys, string(item.Key()))
+	}
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return keys
+}
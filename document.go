@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"iter"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// DocumentCollection stores JSON objects in a Collection under IDs taken from
+// its sequence.
+//
+// Fields can be indexed by their dotted path with CreatePathIndex. A path
+// index keeps every scalar found at the path, and every scalar of an array
+// found there, encoded with a type tag so that values of one type sort
+// together and in their natural order.
+type DocumentCollection struct {
+	collection *Collection
+}
+
+// Document is a stored JSON object with its ID.
+type Document struct {
+	ID     uint64
+	Fields map[string]any
+}
+
+// Filter selects documents by the values at dotted paths. A path maps either
+// to a value it has to equal or to an object of operators: $eq, $gt, $gte,
+// $lt, $lte and $in. When the path holds an array, any of its elements can
+// match.
+type Filter map[string]any
+
+var (
+	documentNotFoundErr = errors.New("document not found")
+	notAnObjectErr      = errors.New("document is not a JSON object")
+	unknownOperatorErr  = errors.New("unknown filter operator")
+)
+
+const pathIndexPrefix = "$path:"
+
+// NewDocumentCollection stores documents in collection. The extractors of
+// its path indexes are registered again, so they don't need CreatePathIndex
+// after the database is opened.
+func NewDocumentCollection(collection *Collection) *DocumentCollection {
+	for _, name := range collection.indexes {
+		path, ok := strings.CutPrefix(string(name), pathIndexPrefix)
+		if ok {
+			collection.tx.db.addExtractor(collection.path(), name, pathExtractor(path))
+		}
+	}
+	return &DocumentCollection{collection}
+}
+
+func (d *DocumentCollection) Collection() *Collection {
+	return d.collection
+}
+
+// InsertDoc stores fields, which has to marshal to a JSON object, under a
+// new ID and returns the ID.
+func (d *DocumentCollection) InsertDoc(fields any) (uint64, error) {
+	value, err := marshalObject(fields)
+	if err != nil {
+		return 0, err
+	}
+	id, err := d.collection.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	return id, d.collection.Put(documentKey(id), value)
+}
+
+// GetDoc returns the document stored under id, or nil if there is none.
+func (d *DocumentCollection) GetDoc(id uint64) (*Document, error) {
+	item, err := d.collection.Find(documentKey(id))
+	if err != nil || item == nil {
+		return nil, err
+	}
+	return decodeDocument(item)
+}
+
+// UpdateDoc applies patch to the document stored under id as a JSON merge
+// patch: fields set to null are removed, objects are merged recursively and
+// anything else replaces the value it is set on. The document keeps its
+// expiry time.
+func (d *DocumentCollection) UpdateDoc(id uint64, patch any) error {
+	normalized, err := normalize(patch)
+	if err != nil {
+		return err
+	}
+	_, err = d.collection.rewrite(documentKey(id), func(current *Item) ([]byte, bool, error) {
+		if current == nil || current.isCollection() || current.isBlob() {
+			return nil, false, documentNotFoundErr
+		}
+		var fields any
+		if err := json.Unmarshal(current.value, &fields); err != nil {
+			return nil, false, err
+		}
+		value, err := marshalObject(mergePatch(fields, normalized))
+		return value, err == nil, err
+	})
+	return err
+}
+
+func (d *DocumentCollection) DeleteDoc(id uint64) error {
+	return d.collection.Remove(documentKey(id))
+}
+
+// CreatePathIndex indexes the documents by the values at path, a dotted
+// path of object fields. Find uses it for filters on that path.
+func (d *DocumentCollection) CreatePathIndex(path string) (*Index, error) {
+	return d.collection.CreateIndex([]byte(pathIndexPrefix+path), pathExtractor(path))
+}
+
+// Find iterates over the documents matching filter. When one of the filtered
+// paths is indexed the index narrows down the documents to look at; the
+// whole filter is checked on each of them either way.
+func (d *DocumentCollection) Find(filter Filter) iter.Seq2[*Document, error] {
+	return func(yield func(*Document, error) bool) {
+		predicates, err := compileFilter(filter)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+
+		items, err := d.candidates(predicates)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		seen := map[string]bool{}
+		for item, err := range items {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if item.isCollection() || seen[string(item.key)] {
+				continue
+			}
+			seen[string(item.key)] = true
+
+			doc, err := decodeDocument(item)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if matchesAll(predicates, doc.Fields) && !yield(doc, nil) {
+				return
+			}
+		}
+	}
+}
+
+// candidates returns the items that may match predicates, going through the
+// index of the first filtered path that has one and scanning the whole
+// collection otherwise.
+func (d *DocumentCollection) candidates(predicates []predicate) (iter.Seq2[*Item, error], error) {
+	for _, p := range predicates {
+		index, err := d.collection.Index([]byte(pathIndexPrefix + p.path))
+		if err != nil {
+			return nil, err
+		}
+		if index == nil {
+			continue
+		}
+		if items, ok := p.lookup(index); ok {
+			return items, nil
+		}
+	}
+
+	return func(yield func(*Item, error) bool) {
+		cursor := d.collection.Cursor()
+		item, err := cursor.First()
+		for ; item != nil; item, err = cursor.Next() {
+			if !yield(item, nil) {
+				return
+			}
+		}
+		if err != nil {
+			yield(nil, err)
+		}
+	}, nil
+}
+
+// predicate is a compiled filter on one path. Every operator of the path
+// has to match.
+type predicate struct {
+	path      string
+	operators map[string]any
+}
+
+func compileFilter(filter Filter) ([]predicate, error) {
+	var predicates []predicate
+	for path, condition := range filter {
+		condition, err := normalize(condition)
+		if err != nil {
+			return nil, err
+		}
+		operators, ok := condition.(map[string]any)
+		if !ok || !hasOperators(operators) {
+			operators = map[string]any{"$eq": condition}
+		}
+		for op, operand := range operators {
+			switch op {
+			case "$eq", "$gt", "$gte", "$lt", "$lte":
+			case "$in":
+				if _, ok := operand.([]any); !ok {
+					return nil, unknownOperatorErr
+				}
+			default:
+				return nil, unknownOperatorErr
+			}
+		}
+		predicates = append(predicates, predicate{path, operators})
+	}
+	slices.SortFunc(predicates, func(a, b predicate) int {
+		return strings.Compare(a.path, b.path)
+	})
+	return predicates, nil
+}
+
+func hasOperators(condition map[string]any) bool {
+	for key := range condition {
+		if strings.HasPrefix(key, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAll(predicates []predicate, fields map[string]any) bool {
+	for _, p := range predicates {
+		if !p.matches(fields) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p predicate) matches(fields map[string]any) bool {
+	value, ok := lookupPath(fields, p.path)
+	if !ok {
+		return false
+	}
+	if p.matchesValue(value) {
+		return true
+	}
+	if elements, ok := value.([]any); ok {
+		for _, element := range elements {
+			if p.matchesValue(element) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p predicate) matchesValue(value any) bool {
+	for op, operand := range p.operators {
+		switch op {
+		case "$eq":
+			if !reflect.DeepEqual(value, operand) {
+				return false
+			}
+		case "$in":
+			if !slices.ContainsFunc(operand.([]any), func(v any) bool { return reflect.DeepEqual(value, v) }) {
+				return false
+			}
+		default:
+			res, ok := compareValues(value, operand)
+			if !ok {
+				return false
+			}
+			if op == "$gt" && res <= 0 || op == "$gte" && res < 0 || op == "$lt" && res >= 0 || op == "$lte" && res > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// lookup returns the items index holds for the values p can match, if p
+// can be answered from an index.
+func (p predicate) lookup(index *Index) (iter.Seq2[*Item, error], bool) {
+	if operand, ok := p.operators["$eq"]; ok {
+		value, ok := encodeScalar(operand)
+		if !ok {
+			return nil, false
+		}
+		return index.Find(value), true
+	}
+
+	if operand, ok := p.operators["$in"]; ok {
+		var values [][]byte
+		for _, v := range operand.([]any) {
+			value, ok := encodeScalar(v)
+			if !ok {
+				return nil, false
+			}
+			values = append(values, value)
+		}
+		return func(yield func(*Item, error) bool) {
+			for _, value := range values {
+				for item, err := range index.Find(value) {
+					if !yield(item, err) {
+						return
+					}
+				}
+			}
+		}, true
+	}
+
+	// A range stays within the values of its operands' type: from the lower
+	// bound or the start of the type, up to the upper bound or the end of it.
+	var start, end []byte
+	for op, operand := range p.operators {
+		value, ok := encodeScalar(operand)
+		if !ok {
+			return nil, false
+		}
+		switch op {
+		case "$gt", "$gte":
+			start = value
+		case "$lt":
+			end = value
+		case "$lte":
+			end = []byte{value[0] + 1}
+		}
+	}
+	if start == nil && end == nil {
+		return nil, false
+	}
+	if start == nil {
+		start = end[:1]
+	}
+	if end == nil || end[0] != start[0] {
+		end = []byte{start[0] + 1}
+	}
+	return index.Range(start, end), true
+}
+
+func pathExtractor(path string) IndexExtractor {
+	return func(key, value []byte) [][]byte {
+		var fields map[string]any
+		if err := json.Unmarshal(value, &fields); err != nil {
+			return nil
+		}
+		found, ok := lookupPath(fields, path)
+		if !ok {
+			return nil
+		}
+
+		elements := []any{found}
+		if array, ok := found.([]any); ok {
+			elements = array
+		}
+		var values [][]byte
+		for _, element := range elements {
+			if value, ok := encodeScalar(element); ok {
+				values = append(values, value)
+			}
+		}
+		return values
+	}
+}
+
+func lookupPath(fields map[string]any, path string) (any, bool) {
+	var value any = fields
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		value, ok = object[name]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// The type tags of encodeScalar, in the order the types sort in.
+const (
+	nullTag uint8 = iota
+	boolTag
+	numberTag
+	stringTag
+)
+
+// encodeScalar encodes a JSON scalar so that encoded values compare with
+// bytes.Compare like the values do. Objects and arrays can't be encoded.
+func encodeScalar(value any) ([]byte, bool) {
+	switch v := value.(type) {
+	case nil:
+		return []byte{nullTag}, true
+	case bool:
+		if v {
+			return []byte{boolTag, 1}, true
+		}
+		return []byte{boolTag, 0}, true
+	case float64:
+		if v == 0 {
+			v = 0
+		}
+		bits := math.Float64bits(v)
+		if bits&signBit != 0 {
+			bits = ^bits
+		} else {
+			bits |= signBit
+		}
+		return binary.BigEndian.AppendUint64([]byte{numberTag}, bits), true
+	case string:
+		return append([]byte{stringTag}, v...), true
+	}
+	return nil, false
+}
+
+// compareValues orders two numbers or two strings.
+func compareValues(a, b any) (int, bool) {
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	}
+	return 0, false
+}
+
+// mergePatch applies patch to target as described in RFC 7386.
+func mergePatch(target, patch any) any {
+	fields, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	object, ok := target.(map[string]any)
+	if !ok {
+		object = map[string]any{}
+	}
+	for name, value := range fields {
+		if value == nil {
+			delete(object, name)
+		} else {
+			object[name] = mergePatch(object[name], value)
+		}
+	}
+	return object
+}
+
+// normalize turns a Go value into what encoding/json decodes it to, so it
+// compares with decoded documents.
+func normalize(value any) (any, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var normalized any
+	err = json.Unmarshal(b, &normalized)
+	return normalized, err
+}
+
+func marshalObject(fields any) ([]byte, error) {
+	value, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(value)) == 0 || bytes.TrimSpace(value)[0] != '{' {
+		return nil, notAnObjectErr
+	}
+	return value, nil
+}
+
+func documentKey(id uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, id)
+}
+
+func decodeDocument(item *Item) (*Document, error) {
+	doc := &Document{ID: binary.BigEndian.Uint64(item.key)}
+	if err := json.Unmarshal(item.plainValue(), &doc.Fields); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func documentIDs(tb testing.TB, documents *DocumentCollection, filter Filter) []uint64 {
+	tb.Helper()
+	var ids []uint64
+	for document, err := range documents.Find(filter) {
+		if err != nil {
+			tb.Fatal(err)
+		}
+		ids = append(ids, document.ID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestDocuments(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("docs"), nil)
+		if err != nil {
+			return err
+		}
+		documents := NewDocumentCollection(c)
+		id, err := documents.InsertDoc(map[string]any{
+			"name":    "ann",
+			"address": map[string]any{"city": "oslo", "zip": "0150"},
+			"tags":    []any{"a", "b"},
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := documents.InsertDoc([]int{1, 2}); err != notAnObjectErr {
+			t.Errorf("inserting an array returned %v, want %v", err, notAnObjectErr)
+		}
+
+		// null removes a field, objects merge and anything else replaces.
+		if err := documents.UpdateDoc(id, map[string]any{
+			"name":    nil,
+			"address": map[string]any{"city": "rome"},
+			"tags":    []any{"c"},
+		}); err != nil {
+			return err
+		}
+		document, err := documents.GetDoc(id)
+		if err != nil {
+			return err
+		}
+		want := "map[address:map[city:rome zip:0150] tags:[c]]"
+		if document == nil || fmt.Sprint(document.Fields) != want {
+			t.Errorf("GetDoc returned %v, want %s", document, want)
+		}
+
+		if err := documents.DeleteDoc(id); err != nil {
+			return err
+		}
+		if document, err := documents.GetDoc(id); err != nil || document != nil {
+			t.Errorf("GetDoc returned %v, %v after DeleteDoc", document, err)
+		}
+		if err := documents.UpdateDoc(id, map[string]any{}); err != documentNotFoundErr {
+			t.Errorf("UpdateDoc of a deleted document returned %v, want %v", err, documentNotFoundErr)
+		}
+		return nil
+	})
+}
+
+func TestFindDocuments(t *testing.T) {
+	tests := []struct {
+		filter Filter
+		want   []uint64
+	}{
+		{Filter{"city": "oslo"}, []uint64{1, 3}},
+		{Filter{"age": map[string]any{"$gt": 30}}, []uint64{2, 3}},
+		{Filter{"age": map[string]any{"$gte": 30, "$lt": 40}}, []uint64{1, 2}},
+		{Filter{"city": map[string]any{"$in": []any{"rome", "paris"}}}, []uint64{2, 4}},
+		{Filter{"tags": "admin"}, []uint64{1, 4}},
+		{Filter{"city": "oslo", "age": 30}, []uint64{1}},
+		{Filter{"city": "nowhere"}, nil},
+	}
+	for _, indexed := range []bool{false, true} {
+		t.Run(fmt.Sprint("indexed=", indexed), func(t *testing.T) {
+			db := openTestDB(t, nil)
+			update(t, db, func(tx *Tx) error {
+				c, err := tx.CreateCollection([]byte("docs"), nil)
+				if err != nil {
+					return err
+				}
+				documents := NewDocumentCollection(c)
+				for _, fields := range []map[string]any{
+					{"city": "oslo", "age": 30, "tags": []any{"admin"}},
+					{"city": "rome", "age": 35},
+					{"city": "oslo", "age": 41},
+					{"city": "paris", "tags": []any{"user", "admin"}},
+				} {
+					if _, err := documents.InsertDoc(fields); err != nil {
+						return err
+					}
+				}
+				if indexed {
+					for _, path := range []string{"city", "age", "tags"} {
+						if _, err := documents.CreatePathIndex(path); err != nil {
+							return err
+						}
+					}
+				}
+
+				for _, test := range tests {
+					if got := documentIDs(t, documents, test.filter); !slices.Equal(got, test.want) {
+						t.Errorf("Find(%v) returned %v, want %v", test.filter, got, test.want)
+					}
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestPathIndexesAfterReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDBAt(t, path, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("docs"), nil)
+		if err != nil {
+			return err
+		}
+		documents := NewDocumentCollection(c)
+		if _, err := documents.CreatePathIndex("city"); err != nil {
+			return err
+		}
+		_, err = documents.InsertDoc(map[string]any{"city": "oslo"})
+		return err
+	})
+	_ = db.Close()
+
+	db = openTestDBAt(t, path, nil)
+	// Read transactions register the extractors of path indexes
+	// concurrently.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tx := db.ReadTx()
+			defer tx.Rollback()
+			c, err := tx.GetCollection([]byte("docs"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			var got []uint64
+			for document, err := range NewDocumentCollection(c).Find(Filter{"city": "oslo"}) {
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				got = append(got, document.ID)
+			}
+			if !slices.Equal(got, []uint64{1}) {
+				t.Errorf("Find returned %v, want [1]", got)
+			}
+		}()
+	}
+	wg.Wait()
+
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("docs"))
+		if err != nil {
+			return err
+		}
+		documents := NewDocumentCollection(c)
+		_, err = documents.InsertDoc(map[string]any{"city": "oslo"})
+		if err != nil {
+			return err
+		}
+		if got := documentIDs(t, documents, Filter{"city": "oslo"}); !slices.Equal(got, []uint64{1, 2}) {
+			t.Errorf("Find returned %v, want [1 2]", got)
+		}
+		return nil
+	})
+}
+
+func TestUpdateDocKeepsTheExpiry(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("docs"), nil)
+		if err != nil {
+			return err
+		}
+		documents := NewDocumentCollection(c)
+		id, err := documents.InsertDoc(map[string]any{"name": "ann"})
+		if err != nil {
+			return err
+		}
+		value, err := c.Get(documentKey(id))
+		if err != nil {
+			return err
+		}
+		if err := c.PutWithTTL(documentKey(id), value, time.Hour); err != nil {
+			return err
+		}
+		if err := documents.UpdateDoc(id, map[string]any{"age": 3}); err != nil {
+			return err
+		}
+		item, err := c.find(documentKey(id))
+		if err != nil {
+			return err
+		}
+		if !item.isExpiring() || time.Until(item.expiresAt()) < 59*time.Minute {
+			t.Error("UpdateDoc dropped the expiry of the document")
+		}
+		return nil
+	})
+}
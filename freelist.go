@@ -9,10 +9,18 @@ const (
 	initialPage = 0
 )
 
+// The freelist is stored as a chain of pages starting at meta.freeListPage.
+// Each page holds the number of the next page in the chain (0 at the end),
+// a count and that many released page numbers; the first page also records
+// maxPage. Pages beyond the first are borrowed from the released pages
+// themselves and handed back once a newer chain has been written.
 type freeList struct {
 	maxPage pageNumber
 	releasedPages []pageNumber
 
+	// chainPages are the pages beyond the first that hold the list as last
+	// written. They are reserved until a newer list has replaced them.
+	chainPages []pageNumber
 }
 
 
@@ -33,31 +41,69 @@ func (fr *freeList) getNextPage() pageNumber {
 	return fr.maxPage
 }
 
+// appendPage returns a page past the end of the file, ignoring the released
+// pages, for callers that want their pages in order.
+func (fr *freeList) appendPage() pageNumber {
+	fr.maxPage += 1
+	return fr.maxPage
+}
+
 func (f *freeList) releasePage(number pageNumber){
 	f.releasedPages = append(f.releasedPages, number) 
 }
 
+func (fr *freeList) capacity(pageSize int, extraPages int) int {
+	return (pageSize-2*pageNumberSize-2)/pageNumberSize + extraPages*((pageSize-pageNumberSize-2)/pageNumberSize)
+}
 
+// extraPages takes enough released pages to hold the rest of the list.
+func (fr *freeList) extraPages(pageSize int) []pageNumber {
+	extra := []pageNumber{}
+	for len(fr.releasedPages) > fr.capacity(pageSize, len(extra)) {
+		extra = append(extra, fr.getNextPage())
+	}
+	return extra
+}
 
-func (fr *freeList) serialize(buf []byte) []byte {
-	pos := 0
-	binary.LittleEndian.PutUint16(buf[pos:], uint16(fr.maxPage))
-	pos += 2
-	binary.LittleEndian.PutUint16(buf[pos:], uint16(len(fr.releasedPages)))
-	pos += 2
-
-	for _, page := range fr.releasedPages {
-		binary.LittleEndian.PutUint64(buf[pos:], uint64(page))
+func (fr *freeList) serialize(pages []*page) {
+	releasedPages := fr.releasedPages
+	for i, p := range pages {
+		buf := p.data
+		pos := 0
+		if i == 0 {
+			binary.LittleEndian.PutUint64(buf[pos:], uint64(fr.maxPage))
+			pos += pageNumberSize
+		}
+
+		var next pageNumber
+		if i+1 < len(pages) {
+			next = pages[i+1].number
+		}
+		binary.LittleEndian.PutUint64(buf[pos:], uint64(next))
 		pos += pageNumberSize
 
+		count := min(len(releasedPages), (len(buf)-pos-2)/pageNumberSize)
+		binary.LittleEndian.PutUint16(buf[pos:], uint16(count))
+		pos += 2
+
+		for _, page := range releasedPages[:count] {
+			binary.LittleEndian.PutUint64(buf[pos:], uint64(page))
+			pos += pageNumberSize
+		}
+		releasedPages = releasedPages[count:]
 	}
-	return buf
 }
 
-func (fr *freeList) deserialize(buf []byte) {
+func (fr *freeList) deserialize(buf []byte, first bool) pageNumber {
 	pos := 0
-	fr.maxPage = pageNumber(binary.LittleEndian.Uint16(buf[pos:]))
-	pos += 2
+	if first {
+		fr.maxPage = pageNumber(binary.LittleEndian.Uint64(buf[pos:]))
+		pos += pageNumberSize
+	}
+
+	next := pageNumber(binary.LittleEndian.Uint64(buf[pos:]))
+	pos += pageNumberSize
+
 	releasedPagesCount := int(binary.LittleEndian.Uint16(buf[pos:]))
 	pos += 2
 
@@ -65,4 +111,5 @@ func (fr *freeList) deserialize(buf []byte) {
 		fr.releasedPages = append(fr.releasedPages, pageNumber(binary.LittleEndian.Uint64(buf[pos:])))
 		pos += pageNumberSize
 	}
-}
\ No newline at end of file
+	return next
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDeleteCollectionFreesEveryPage(t *testing.T) {
+	tests := []struct {
+		name string
+		// sameTx deletes the collection in the transaction that filled it,
+		// while its handles are still open.
+		sameTx bool
+	}{
+		{"committed", false},
+		{"open handles", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := openTestDB(t, nil)
+			before := usedPages(db)
+
+			fill := func(tx *Tx) error {
+				c, err := tx.CreateCollection([]byte("c"), nil)
+				if err != nil {
+					return err
+				}
+				if _, err := c.CreateIndex([]byte("value"), func(key, value []byte) [][]byte {
+					return [][]byte{value[:1]}
+				}); err != nil {
+					return err
+				}
+				child, err := c.CreateCollection([]byte("child"), nil)
+				if err != nil {
+					return err
+				}
+				for i := 0; i < 3000; i++ {
+					if err := c.Put(benchKey(i), make([]byte, 100)); err != nil {
+						return err
+					}
+					if err := child.Put(benchKey(i), make([]byte, 100)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			update(t, db, func(tx *Tx) error {
+				if err := fill(tx); err != nil {
+					return err
+				}
+				if test.sameTx {
+					return tx.DeleteCollection([]byte("c"))
+				}
+				return nil
+			})
+			if !test.sameTx {
+				update(t, db, func(tx *Tx) error {
+					return tx.DeleteCollection([]byte("c"))
+				})
+			}
+
+			if used := usedPages(db); used != before {
+				t.Errorf("%d pages in use after deleting the collection, want %d", used, before)
+			}
+		})
+	}
+}
+
+func TestFreelistSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDBAt(t, path, nil)
+	// Enough released pages for the list to take several pages.
+	for round := 0; round < 3; round++ {
+		update(t, db, func(tx *Tx) error {
+			c, err := tx.CreateCollection([]byte("c"), nil)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 10000; i++ {
+				if err := c.Put(benchKey(i), make([]byte, 200)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		update(t, db, func(tx *Tx) error {
+			return tx.DeleteCollection([]byte("c"))
+		})
+		if len(db.chainPages) == 0 {
+			t.Fatal("the freelist fits in one page, the test needs more")
+		}
+		for _, page := range db.chainPages {
+			if slices.Contains(db.releasedPages, page) {
+				t.Fatalf("page %d holds the freelist and is released too", page)
+			}
+		}
+	}
+	maxPage := db.maxPage
+	released := slices.Clone(db.releasedPages)
+	chain := slices.Clone(db.chainPages)
+	_ = db.Close()
+
+	db = openTestDBAt(t, path, nil)
+	if db.maxPage != maxPage {
+		t.Errorf("maxPage is %d after reopening, want %d", db.maxPage, maxPage)
+	}
+	slices.Sort(released)
+	got := slices.Sorted(slices.Values(db.releasedPages))
+	if !slices.Equal(got, released) {
+		t.Errorf("%d released pages after reopening, want %d", len(got), len(released))
+	}
+	if !slices.Equal(db.chainPages, chain) {
+		t.Errorf("freelist chain is %v after reopening, want %v", db.chainPages, chain)
+	}
+}
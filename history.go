@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"iter"
+	"time"
+)
+
+// historyCollectionName is the internal collection inside a collection with
+// History set that keeps the versions of its keys.
+const historyCollectionName = "\x00history"
+
+// A history entry is keyed by the key, escaped like an index value, and the
+// big-endian ID of the transaction that replaced the version, so the
+// versions of a key sort by the transaction. Its value holds the time the
+// version was replaced, the ID of the transaction that wrote it, whether
+// the key existed and the value.
+//
+// Once versions of a key are pruned a floor entry takes their place, keyed
+// like the newest of them. Its flag is historyFloor and, instead of the
+// ID of the transaction that wrote it, it holds the last span of
+// transactions the pruned versions show the key wasn't there in: the ID
+// of the transaction the span starts at, and the one that ends it
+// following the flag. Below the floor the key is reported as not found in
+// that span and as pruned anywhere else.
+const (
+	historyHeaderSize = 8 + 8 + 1
+	historyFloor      = 2
+)
+
+var historyPrunedErr = errors.New("the history of the key doesn't reach back to the transaction")
+
+// Version is a value a key had until the transaction TxID replaced or
+// removed it at Time. Exists is false for a version recording that the key
+// wasn't there.
+type Version struct {
+	TxID   uint64
+	Time   time.Time
+	Value  []byte
+	Exists bool
+}
+
+// History iterates over the versions kept for key, oldest first. The value
+// the key has now is not one of them.
+func (c *Collection) History(key []byte) iter.Seq2[Version, error] {
+	return func(yield func(Version, error) bool) {
+		history, err := c.internalCollection([]byte(historyCollectionName), false)
+		if err != nil {
+			yield(Version{}, err)
+			return
+		}
+		if history == nil {
+			return
+		}
+
+		entries, err := history.versions(key)
+		if err != nil {
+			yield(Version{}, err)
+			return
+		}
+		for _, entry := range entries {
+			if isHistoryFloor(entry) {
+				continue
+			}
+			version, _ := decodeVersion(entry)
+			if !yield(version, nil) {
+				return
+			}
+		}
+	}
+}
+
+// GetAsOf returns a copy of the value key had once the transaction txid
+// committed, or nil if it wasn't there. It fails if the versions from back
+// then have been pruned, unless the key is known not to have been there.
+func (c *Collection) GetAsOf(key []byte, txid uint64) ([]byte, error) {
+	if txid < c.tx.id {
+		history, err := c.internalCollection([]byte(historyCollectionName), false)
+		if err != nil {
+			return nil, err
+		}
+		if history != nil {
+			prefix := appendIndexValue(nil, key)
+			cursor := history.Cursor()
+			entry, err := cursor.seek(historyKey(key, txid+1))
+			if err != nil {
+				return nil, err
+			}
+			if entry != nil && bytes.HasPrefix(entry.key, prefix) {
+				version, since := decodeVersion(entry)
+				if !isHistoryFloor(entry) && since <= txid {
+					return version.Value, nil
+				}
+				floor, err := cursor.seek(prefix)
+				if err != nil {
+					return nil, err
+				}
+				if isHistoryFloor(floor) {
+					if from, to := floorAbsence(floor); from <= txid && txid < to {
+						return nil, nil
+					}
+				}
+				return nil, historyPrunedErr
+			}
+		}
+	}
+	return c.Get(key)
+}
+
+// PruneHistory applies the retention policy of c to the versions of every
+// key. Writes only prune the versions of the key they write, so versions
+// of keys that aren't written anymore outlive HistoryAge until this runs.
+func (c *Collection) PruneHistory() error {
+	if !c.tx.write {
+		return writeInsideReadTxErr
+	}
+	history, err := c.internalCollection([]byte(historyCollectionName), false)
+	if err != nil || history == nil {
+		return err
+	}
+
+	var keys [][]*Item
+	cursor := history.Cursor()
+	entry, err := cursor.first()
+	for ; entry != nil; entry, err = cursor.next() {
+		if n := len(keys); n != 0 && sameHistoryKey(keys[n-1][0].key, entry.key) {
+			keys[n-1] = append(keys[n-1], entry)
+		} else {
+			keys = append(keys, []*Item{entry})
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entries := range keys {
+		if err := c.pruneVersions(history, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkHistory fails if the versions of c can't be recorded, so that a
+// write finds out before it changes the tree.
+func (c *Collection) checkHistory() error {
+	if !c.meta.History || c.internal {
+		return nil
+	}
+	_, err := c.internalCollection([]byte(historyCollectionName), false)
+	return err
+}
+
+// recordHistory keeps old, the item key had before this write, as a version
+// of key if c has History set. Only the first write of a key in a
+// transaction records a version, the one the transaction started from.
+func (c *Collection) recordHistory(key []byte, old *Item) error {
+	if !c.meta.History || c.internal {
+		return nil
+	}
+	history, err := c.internalCollection([]byte(historyCollectionName), true)
+	if err != nil {
+		return err
+	}
+	entries, err := history.versions(key)
+	if err != nil {
+		return err
+	}
+
+	var since uint64
+	if len(entries) != 0 {
+		since = historyTxID(entries[len(entries)-1])
+		if since == c.tx.id {
+			return nil
+		}
+	}
+
+	value := binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+	value = binary.LittleEndian.AppendUint64(value, since)
+	if old = c.current(old); old != nil {
+		value = append(append(value, 1), old.value...)
+	} else {
+		value = append(value, 0)
+	}
+	entry := NewItem(historyKey(key, c.tx.id), value)
+	if err := history.put(entry); err != nil {
+		return err
+	}
+	return c.pruneVersions(history, append(entries, entry))
+}
+
+// pruneVersions removes the entries, those of one key from oldest to
+// newest, that the retention policy of c drops, and replaces the floor of
+// the key with one above them.
+func (c *Collection) pruneVersions(history *Collection, entries []*Item) error {
+	var floor *Item
+	if len(entries) != 0 && isHistoryFloor(entries[0]) {
+		floor, entries = entries[0], entries[1:]
+	}
+	expired := c.expiredVersions(entries)
+	if len(expired) == 0 {
+		return nil
+	}
+
+	newest := expired[len(expired)-1]
+	key := bytes.Clone(newest.key)
+	value := append([]byte{}, newest.value[:8]...)
+
+	var from, to uint64
+	if floor != nil {
+		from, to = floorAbsence(floor)
+		if err := history.Remove(floor.key); err != nil {
+			return err
+		}
+	}
+	for _, entry := range expired {
+		if version, since := decodeVersion(entry); !version.Exists {
+			from, to = since, version.TxID
+		}
+		if err := history.Remove(entry.key); err != nil {
+			return err
+		}
+	}
+
+	value = binary.LittleEndian.AppendUint64(value, from)
+	value = binary.LittleEndian.AppendUint64(append(value, historyFloor), to)
+	return history.put(NewItem(key, value))
+}
+
+// expiredVersions returns the entries, the versions of one key from oldest
+// to newest, that the retention policy of c drops. Versions older than a
+// dropped one are dropped too.
+func (c *Collection) expiredVersions(entries []*Item) []*Item {
+	var excess int
+	if c.meta.HistoryVersions > 0 && len(entries) > c.meta.HistoryVersions {
+		excess = len(entries) - c.meta.HistoryVersions
+	}
+	cutoff := time.Now().Add(-c.meta.HistoryAge)
+
+	for i, entry := range entries {
+		version, _ := decodeVersion(entry)
+		if c.meta.HistoryAge > 0 && version.Time.Before(cutoff) {
+			excess = max(excess, i+1)
+		}
+	}
+	return entries[:excess]
+}
+
+// versions returns the entries kept for key in c, a history collection,
+// oldest first.
+func (c *Collection) versions(key []byte) ([]*Item, error) {
+	prefix := appendIndexValue(nil, key)
+	var entries []*Item
+	cursor := c.Cursor()
+	entry, err := cursor.seek(prefix)
+	for ; entry != nil && bytes.HasPrefix(entry.key, prefix); entry, err = cursor.next() {
+		entries = append(entries, entry)
+	}
+	return entries, err
+}
+
+func historyKey(key []byte, txid uint64) []byte {
+	return binary.BigEndian.AppendUint64(appendIndexValue(nil, key), txid)
+}
+
+// historyTxID returns the ID of the transaction that replaced the version
+// kept in entry.
+func historyTxID(entry *Item) uint64 {
+	return binary.BigEndian.Uint64(entry.key[len(entry.key)-txidSize:])
+}
+
+func isHistoryFloor(entry *Item) bool {
+	return entry != nil && entry.value[historyHeaderSize-1] == historyFloor
+}
+
+// floorAbsence returns the span of transactions, from the first to the one
+// that ends it, that the floor entry records the key wasn't there in.
+func floorAbsence(floor *Item) (uint64, uint64) {
+	return binary.LittleEndian.Uint64(floor.value[8:]), binary.LittleEndian.Uint64(floor.value[historyHeaderSize:])
+}
+
+func sameHistoryKey(a, b []byte) bool {
+	return bytes.Equal(a[:len(a)-txidSize], b[:len(b)-txidSize])
+}
+
+// decodeVersion returns the version kept in a history entry and the ID of
+// the transaction that wrote it.
+func decodeVersion(entry *Item) (Version, uint64) {
+	version := Version{
+		TxID:   historyTxID(entry),
+		Time:   time.Unix(0, int64(binary.LittleEndian.Uint64(entry.value))),
+		Exists: entry.value[historyHeaderSize-1] == 1,
+	}
+	if version.Exists {
+		version.Value = append([]byte{}, entry.value[historyHeaderSize:]...)
+	}
+	return version, binary.LittleEndian.Uint64(entry.value[8:])
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// writeVersions creates a collection with options and then, one
+// transaction each, puts every value, or removes the key for an empty one.
+// It returns the ID of each of those transactions.
+func writeVersions(tb testing.TB, db *DB, options *CollectionOptions, values ...string) []uint64 {
+	tb.Helper()
+	update(tb, db, func(tx *Tx) error {
+		_, err := tx.CreateCollection([]byte("c"), options)
+		return err
+	})
+	var ids []uint64
+	for _, value := range values {
+		update(tb, db, func(tx *Tx) error {
+			ids = append(ids, tx.ID())
+			c, err := tx.GetCollection([]byte("c"))
+			if err != nil {
+				return err
+			}
+			if value == "" {
+				return c.Remove([]byte("key"))
+			}
+			return c.Put([]byte("key"), []byte(value))
+		})
+	}
+	return ids
+}
+
+// asOf returns what GetAsOf says key held once each transaction of ids
+// committed, and right before the first one.
+func asOf(tb testing.TB, db *DB, ids []uint64) string {
+	tb.Helper()
+	var got []string
+	view(tb, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		for _, id := range append([]uint64{ids[0] - 1}, ids...) {
+			value, err := c.GetAsOf([]byte("key"), id)
+			switch {
+			case err == historyPrunedErr:
+				got = append(got, "pruned")
+			case err != nil:
+				return err
+			case value == nil:
+				got = append(got, "-")
+			default:
+				got = append(got, string(value))
+			}
+		}
+		return nil
+	})
+	return fmt.Sprint(got)
+}
+
+func TestHistory(t *testing.T) {
+	db := openTestDB(t, nil)
+	ids := writeVersions(t, db, &CollectionOptions{History: true}, "a", "b", "", "c")
+	if got := asOf(t, db, ids); got != "[- a b - c]" {
+		t.Errorf("GetAsOf returned %s, want [- a b - c]", got)
+	}
+
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		// Only the first write of a transaction records a version.
+		for _, value := range []string{"d", "e"} {
+			if err := c.Put([]byte("key"), []byte(value)); err != nil {
+				return err
+			}
+		}
+		var versions []string
+		for version, err := range c.History([]byte("key")) {
+			if err != nil {
+				return err
+			}
+			versions = append(versions, fmt.Sprintf("%d:%s:%v", version.TxID-ids[0], version.Value, version.Exists))
+		}
+		if want := "[0::false 1:a:true 2:b:true 3::false 4:c:true]"; fmt.Sprint(versions) != want {
+			t.Errorf("History returned %v, want %s", versions, want)
+		}
+		return nil
+	})
+}
+
+func TestHistoryRetention(t *testing.T) {
+	db := openTestDB(t, nil)
+	ids := writeVersions(t, db, &CollectionOptions{History: true, HistoryVersions: 2}, "a", "b", "c", "d")
+	// Before the key existed it is still known to be absent.
+	if got := asOf(t, db, ids); got != "[- pruned b c d]" {
+		t.Errorf("GetAsOf returned %s, want [- pruned b c d]", got)
+	}
+}
+
+func TestHistoryPrunedByAge(t *testing.T) {
+	db := openTestDB(t, nil)
+	ids := writeVersions(t, db, &CollectionOptions{History: true, HistoryAge: 10 * time.Millisecond}, "a", "b")
+	time.Sleep(20 * time.Millisecond)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		return c.PruneHistory()
+	})
+	// Every version is gone, yet the key wasn't there before it was
+	// created and its past values can't be told.
+	if got := asOf(t, db, ids); got != "[- pruned b]" {
+		t.Errorf("GetAsOf returned %s after pruning, want [- pruned b]", got)
+	}
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		for version := range c.History([]byte("key")) {
+			t.Errorf("History returned %+v after pruning", version)
+		}
+		return nil
+	})
+
+	// A later write carries on from the pruned versions.
+	update(t, db, func(tx *Tx) error {
+		ids = append(ids, tx.ID())
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		return c.Put([]byte("key"), []byte("c"))
+	})
+	if got := asOf(t, db, ids); got != "[- pruned b c]" {
+		t.Errorf("GetAsOf returned %s after another write, want [- pruned b c]", got)
+	}
+}
+
+func TestHistoryNameIsReserved(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), nil)
+		if err != nil {
+			return err
+		}
+		name := []byte(historyCollectionName)
+		if err := c.Put(name, []byte("value")); err != reservedNameErr {
+			t.Errorf("putting the history name returned %v", err)
+		}
+
+		putUnchecked(t, c, name, []byte("value"))
+		if err := c.Put([]byte("key"), []byte("old")); err != nil {
+			return err
+		}
+		if err := tx.SetCollectionMeta([]byte("c"), CollectionMeta{CollectionOptions: CollectionOptions{History: true}}); err != reservedNameErr {
+			t.Errorf("turning history on returned %v", err)
+		}
+
+		// Writes to a collection that had history on already fail before
+		// they change anything.
+		c.meta.History = true
+		if err := c.Put([]byte("key"), []byte("new")); err != reservedNameErr {
+			t.Errorf("Put returned %v", err)
+		}
+		if err := c.Remove([]byte("key")); err != reservedNameErr {
+			t.Errorf("Remove returned %v", err)
+		}
+		if value, err := c.Get([]byte("key")); err != nil || string(value) != "old" {
+			t.Errorf("the key has %q, %v after the failed writes", value, err)
+		}
+		return nil
+	})
+}
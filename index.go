@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"iter"
+)
+
+// IndexExtractor returns the values an item is indexed under. An item can be
+// indexed under any number of values, including none.
+type IndexExtractor func(key, value []byte) [][]byte
+
+var (
+	ErrUniqueViolation = errors.New("another key is already indexed under the same value")
+
+	missingExtractorErr = errors.New("index extractor is not registered, create the index again after opening the database")
+	indexUniquenessErr  = errors.New("index already exists with a different uniqueness")
+)
+
+// An index is kept in an internal collection nested in the indexed one. Its
+// keys are the indexed value, escaped and terminated so entries sort by
+// value first, followed by the key of the item; its values are empty.
+//
+// Extractors are code and can't be stored in the file. The database keeps
+// them by the path of the indexed collection and the name of the index, so
+// CreateIndex has to be called again every time the database is opened.
+// Writes to a collection fail until all of its extractors are registered.
+type Index struct {
+	name       []byte
+	collection *Collection
+	entries    *Collection
+	extract    IndexExtractor
+	unique     bool
+}
+
+func indexCollectionName(name []byte) []byte {
+	return append([]byte("\x00index\x00"), name...)
+}
+
+// CreateIndex indexes the items of c under the values extractor returns,
+// starting with the items c already holds. Calling it for an existing index
+// registers extractor without rebuilding the index.
+func (c *Collection) CreateIndex(name []byte, extractor IndexExtractor) (*Index, error) {
+	return c.createIndex(name, extractor, false)
+}
+
+// CreateUniqueIndex is like CreateIndex, but Put fails with
+// ErrUniqueViolation when another key is already indexed under one of the
+// values of the item.
+func (c *Collection) CreateUniqueIndex(name []byte, extractor IndexExtractor) (*Index, error) {
+	return c.createIndex(name, extractor, true)
+}
+
+func (c *Collection) createIndex(name []byte, extractor IndexExtractor, unique bool) (*Index, error) {
+	if !c.tx.write {
+		return nil, writeInsideReadTxErr
+	}
+
+	if c.hasIndex(name) {
+		if c.isUnique(name) != unique {
+			return nil, indexUniquenessErr
+		}
+		c.tx.db.setExtractor(c.path(), name, extractor)
+		return c.Index(name)
+	}
+
+	entries, err := c.internalCollection(indexCollectionName(name), true)
+	if err != nil {
+		return nil, err
+	}
+	previous, registered := c.tx.db.getExtractor(c.path(), name)
+	c.tx.db.setExtractor(c.path(), name, extractor)
+	c.indexes = append(c.indexes, name)
+	if unique {
+		c.uniqueIndexes = append(c.uniqueIndexes, name)
+	}
+	c.dirty = true
+
+	index := &Index{name, c, entries, extractor, unique}
+	if err := c.fillIndex(index); err != nil {
+		// Leave no trace of the index, as if it had never been created.
+		c.indexes = c.indexes[:len(c.indexes)-1]
+		if unique {
+			c.uniqueIndexes = c.uniqueIndexes[:len(c.uniqueIndexes)-1]
+		}
+		if registered {
+			c.tx.db.setExtractor(c.path(), name, previous)
+		} else {
+			c.tx.db.deleteExtractor(c.path(), name)
+		}
+		if dropErr := c.dropIndexEntries(name); dropErr != nil {
+			return nil, dropErr
+		}
+		return nil, err
+	}
+	return index, nil
+}
+
+// fillIndex adds the items c already holds to index.
+func (c *Collection) fillIndex(index *Index) error {
+	cursor := c.Cursor()
+	item, err := cursor.first()
+	for ; item != nil; item, err = cursor.next() {
+		if item.isCollection() || item.isBlob() {
+			continue
+		}
+		if err := index.check(item); err != nil {
+			return err
+		}
+		if err := index.add(item); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// dropIndexEntries removes the collection holding the entries of the named
+// index from c, along with every page of it.
+func (c *Collection) dropIndexEntries(name []byte) error {
+	entriesName := indexCollectionName(name)
+	item, err := c.find(entriesName)
+	if err != nil || item == nil {
+		return err
+	}
+	if err := c.release(item); err != nil {
+		return err
+	}
+	return c.remove(entriesName, true)
+}
+
+// Index returns the named index of c, or nil if there is none.
+func (c *Collection) Index(name []byte) (*Index, error) {
+	if !c.hasIndex(name) {
+		return nil, nil
+	}
+	entries, err := c.internalCollection(indexCollectionName(name), false)
+	if err != nil {
+		return nil, err
+	}
+	extractor, _ := c.tx.db.getExtractor(c.path(), name)
+	return &Index{name, c, entries, extractor, c.isUnique(name)}, nil
+}
+
+func (c *Collection) hasIndex(name []byte) bool {
+	return containsName(c.indexes, name)
+}
+
+func (c *Collection) isUnique(name []byte) bool {
+	return containsName(c.uniqueIndexes, name)
+}
+
+func containsName(names [][]byte, name []byte) bool {
+	for _, n := range names {
+		if bytes.Equal(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// openIndexes returns every index of c, failing if the extractor of any of
+// them is missing.
+func (c *Collection) openIndexes() ([]*Index, error) {
+	indexes := make([]*Index, 0, len(c.indexes))
+	for _, name := range c.indexes {
+		index, err := c.Index(name)
+		if err != nil {
+			return nil, err
+		}
+		if index.extract == nil {
+			return nil, missingExtractorErr
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+// updateIndexes moves the index entries of old over to item after old was
+// replaced by it. Either of them may be nil.
+func updateIndexes(indexes []*Index, old *Item, item *Item) error {
+	for _, index := range indexes {
+		if old != nil && !old.isCollection() && !old.isBlob() {
+			if err := index.remove(old); err != nil {
+				return err
+			}
+		}
+		if item != nil && !item.isCollection() && !item.isBlob() {
+			if err := index.add(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// check fails with ErrUniqueViolation if idx is unique and an item with a
+// different key is indexed under one of the values of item. Items that
+// have expired don't count.
+func (idx *Index) check(item *Item) error {
+	if !idx.unique || item.isBlob() {
+		return nil
+	}
+	for _, value := range idx.extract(item.key, item.plainValue()) {
+		for other, err := range idx.Find(value) {
+			if err != nil {
+				return err
+			}
+			if idx.collection.compare(other.key, item.key) != 0 {
+				return ErrUniqueViolation
+			}
+		}
+	}
+	return nil
+}
+
+func (idx *Index) add(item *Item) error {
+	for _, value := range idx.extract(item.key, item.plainValue()) {
+		if err := idx.entries.Put(indexEntry(value, item.key), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (idx *Index) remove(item *Item) error {
+	for _, value := range idx.extract(item.key, item.plainValue()) {
+		if err := idx.entries.Remove(indexEntry(value, item.key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (idx *Index) Name() []byte {
+	return idx.name
+}
+
+// Find iterates over the items indexed under value, in key order.
+func (idx *Index) Find(value []byte) iter.Seq2[*Item, error] {
+	prefix := appendIndexValue(nil, value)
+	return idx.scan(prefix, func(entry []byte) bool {
+		return bytes.HasPrefix(entry, prefix)
+	})
+}
+
+// Range iterates over the items indexed under a value v with
+// start <= v < end, ordered by value and then by key. A nil start or end
+// leaves that side of the range open.
+func (idx *Index) Range(start, end []byte) iter.Seq2[*Item, error] {
+	var from []byte
+	if start != nil {
+		from = appendIndexValue(nil, start)
+	}
+	if end == nil {
+		return idx.scan(from, func([]byte) bool { return true })
+	}
+	to := appendIndexValue(nil, end)
+	return idx.scan(from, func(entry []byte) bool {
+		return bytes.Compare(entry, to) < 0
+	})
+}
+
+func (idx *Index) scan(start []byte, within func(entry []byte) bool) iter.Seq2[*Item, error] {
+	return func(yield func(*Item, error) bool) {
+		cursor := idx.entries.Cursor()
+		entry, err := cursor.Seek(start)
+		for ; entry != nil && within(entry.key); entry, err = cursor.Next() {
+			_, key := readIndexValue(entry.key)
+			item, err := idx.collection.Find(key)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if item != nil && !yield(item, nil) {
+				return
+			}
+		}
+		if err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+func indexEntry(value, key []byte) []byte {
+	return append(appendIndexValue(nil, value), key...)
+}
+
+// appendIndexValue escapes every zero byte of value as 0x00 0xff and ends it
+// with 0x00 0x01, so encoded values sort like the values themselves and
+// none of them is a prefix of another.
+func appendIndexValue(b, value []byte) []byte {
+	for _, c := range value {
+		b = append(b, c)
+		if c == 0 {
+			b = append(b, 0xff)
+		}
+	}
+	return append(b, 0, 1)
+}
+
+// readIndexValue splits an index entry into the value and the item key.
+func readIndexValue(entry []byte) ([]byte, []byte) {
+	var value []byte
+	for i := 0; i < len(entry); i++ {
+		if entry[i] != 0 {
+			value = append(value, entry[i])
+			continue
+		}
+		i++
+		if entry[i] == 1 {
+			return value, entry[i+1:]
+		}
+		value = append(value, 0)
+	}
+	return value, nil
+}
+
+func (db *DB) setExtractor(path [][]byte, name []byte, extractor IndexExtractor) {
+	db.extractorsLock.Lock()
+	defer db.extractorsLock.Unlock()
+	if db.extractors == nil {
+		db.extractors = map[string]IndexExtractor{}
+	}
+	db.extractors[string(append(appendPath(nil, path), name...))] = extractor
+}
+
+// addExtractor registers extractor unless another one already is.
+func (db *DB) addExtractor(path [][]byte, name []byte, extractor IndexExtractor) {
+	db.extractorsLock.Lock()
+	defer db.extractorsLock.Unlock()
+	key := string(append(appendPath(nil, path), name...))
+	if _, ok := db.extractors[key]; ok {
+		return
+	}
+	if db.extractors == nil {
+		db.extractors = map[string]IndexExtractor{}
+	}
+	db.extractors[key] = extractor
+}
+
+func (db *DB) deleteExtractor(path [][]byte, name []byte) {
+	db.extractorsLock.Lock()
+	defer db.extractorsLock.Unlock()
+	delete(db.extractors, string(append(appendPath(nil, path), name...)))
+}
+
+func (db *DB) getExtractor(path [][]byte, name []byte) (IndexExtractor, bool) {
+	db.extractorsLock.RLock()
+	defer db.extractorsLock.RUnlock()
+	extractor, ok := db.extractors[string(append(appendPath(nil, path), name...))]
+	return extractor, ok
+}
+
+// moveExtractors registers the extractors of the collections under oldPath
+// under newPath instead.
+func (db *DB) moveExtractors(oldPath, newPath [][]byte) {
+	db.extractorsLock.Lock()
+	defer db.extractorsLock.Unlock()
+	moved := map[string]IndexExtractor{}
+	for key, extractor := range db.extractors {
+		path, name := readPath([]byte(key))
+		if hasPathPrefix(path, oldPath) {
+			delete(db.extractors, key)
+			moved[string(append(appendPath(nil, movePath(path, oldPath, newPath)), name...))] = extractor
+		}
+	}
+	for key, extractor := range moved {
+		db.extractors[key] = extractor
+	}
+}
+
+// renameExtractors follows a rename of the collection at oldPath. The
+// extractors move back if tx is rolled back.
+func (tx *Tx) renameExtractors(oldPath, newPath [][]byte) {
+	tx.db.moveExtractors(oldPath, newPath)
+	tx.renamedPaths = append(tx.renamedPaths, [2][][]byte{oldPath, newPath})
+}
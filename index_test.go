@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"iter"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// byCity indexes "name:city" values by city.
+func byCity(key, value []byte) [][]byte {
+	_, city, ok := bytes.Cut(value, []byte(":"))
+	if !ok {
+		return nil
+	}
+	return [][]byte{city}
+}
+
+func indexKeys(tb testing.TB, items iter.Seq2[*Item, error]) []string {
+	tb.Helper()
+	var keys []string
+	for item, err := range items {
+		if err != nil {
+			tb.Fatal(err)
+		}
+		keys = append(keys, string(item.Key()))
+	}
+	return keys
+}
+
+func TestIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDBAt(t, path, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("people"), nil)
+		if err != nil {
+			return err
+		}
+		for key, value := range map[string]string{"1": "ann:oslo", "2": "bob:rome", "3": "cid:oslo"} {
+			if err := c.Put([]byte(key), []byte(value)); err != nil {
+				return err
+			}
+		}
+		// The index starts with the items already there.
+		index, err := c.CreateIndex([]byte("city"), byCity)
+		if err != nil {
+			return err
+		}
+		if got := indexKeys(t, index.Find([]byte("oslo"))); fmt.Sprint(got) != "[1 3]" {
+			t.Errorf("oslo has %v, want [1 3]", got)
+		}
+
+		if err := c.Put([]byte("3"), []byte("cid:rome")); err != nil {
+			return err
+		}
+		if err := c.Put([]byte("4"), []byte("dan:\x00zero")); err != nil {
+			return err
+		}
+		if err := c.Remove([]byte("2")); err != nil {
+			return err
+		}
+		if got := indexKeys(t, index.Find([]byte("rome"))); fmt.Sprint(got) != "[3]" {
+			t.Errorf("rome has %v, want [3]", got)
+		}
+		if got := indexKeys(t, index.Find([]byte("\x00zero"))); fmt.Sprint(got) != "[4]" {
+			t.Errorf("a value with a zero byte has %v, want [4]", got)
+		}
+		if got := indexKeys(t, index.Range([]byte("a"), []byte("p"))); fmt.Sprint(got) != "[1]" {
+			t.Errorf("range a to p has %v, want [1]", got)
+		}
+		if got := indexKeys(t, index.Range(nil, nil)); fmt.Sprint(got) != "[4 1 3]" {
+			t.Errorf("the whole index has %v, want [4 1 3]", got)
+		}
+		return nil
+	})
+	_ = db.Close()
+
+	db = openTestDBAt(t, path, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("people"))
+		if err != nil {
+			return err
+		}
+		if err := c.Put([]byte("5"), []byte("eve:oslo")); err != missingExtractorErr {
+			t.Errorf("Put without the extractor returned %v, want %v", err, missingExtractorErr)
+		}
+		index, err := c.CreateIndex([]byte("city"), byCity)
+		if err != nil {
+			return err
+		}
+		if err := c.Put([]byte("5"), []byte("eve:oslo")); err != nil {
+			return err
+		}
+		if got := indexKeys(t, index.Find([]byte("oslo"))); fmt.Sprint(got) != "[1 5]" {
+			t.Errorf("oslo has %v after reopening, want [1 5]", got)
+		}
+		return nil
+	})
+}
+
+func TestUniqueIndex(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("people"), nil)
+		if err != nil {
+			return err
+		}
+		index, err := c.CreateUniqueIndex([]byte("city"), byCity)
+		if err != nil {
+			return err
+		}
+		if err := c.Put([]byte("1"), []byte("ann:oslo")); err != nil {
+			return err
+		}
+		if err := c.Put([]byte("2"), []byte("bob:oslo")); err != ErrUniqueViolation {
+			t.Errorf("Put of a taken value returned %v, want %v", err, ErrUniqueViolation)
+		}
+		// The key holding the value can keep it.
+		if err := c.Put([]byte("1"), []byte("ann2:oslo")); err != nil {
+			t.Errorf("Put of the same value under the same key returned %v", err)
+		}
+		// Values freed by a remove or an expiry can be taken again.
+		if err := c.Remove([]byte("1")); err != nil {
+			return err
+		}
+		if err := c.PutWithTTL([]byte("3"), []byte("cid:rome"), time.Millisecond); err != nil {
+			return err
+		}
+		time.Sleep(2 * time.Millisecond)
+		if err := c.Put([]byte("2"), []byte("bob:oslo")); err != nil {
+			t.Errorf("Put of a removed value returned %v", err)
+		}
+		if err := c.Put([]byte("4"), []byte("dan:rome")); err != nil {
+			t.Errorf("Put of an expired value returned %v", err)
+		}
+		if got := indexKeys(t, index.Find([]byte("oslo"))); fmt.Sprint(got) != "[2]" {
+			t.Errorf("oslo has %v, want [2]", got)
+		}
+
+		if _, err := c.CreateIndex([]byte("city"), byCity); err != indexUniquenessErr {
+			t.Errorf("recreating the index as not unique returned %v, want %v", err, indexUniquenessErr)
+		}
+		return nil
+	})
+}
+
+func TestUniqueIndexBackfillFailure(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("people"), nil)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 500; i++ {
+			// Only the last two share a city.
+			city := fmt.Sprint(i)
+			if i == 499 {
+				city = "0"
+			}
+			if err := c.Put(benchKey(i), []byte("name:"+city)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	before := usedPages(db)
+
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("people"))
+		if err != nil {
+			return err
+		}
+		if _, err := c.CreateUniqueIndex([]byte("city"), byCity); err != ErrUniqueViolation {
+			t.Errorf("CreateUniqueIndex returned %v, want %v", err, ErrUniqueViolation)
+		}
+		if index, err := c.Index([]byte("city")); err != nil || index != nil {
+			t.Errorf("Index returned %v, %v after the failed backfill", index, err)
+		}
+		if _, registered := db.getExtractor(c.path(), []byte("city")); registered {
+			t.Error("the extractor stayed registered")
+		}
+		// Writes don't look for the extractor of the dropped index.
+		return c.Put([]byte("new"), []byte("name:1"))
+	})
+
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("people"))
+		if err != nil {
+			return err
+		}
+		return c.Remove([]byte("new"))
+	})
+	if used := usedPages(db); used != before {
+		t.Errorf("%d pages in use after the failed backfill, want %d", used, before)
+	}
+}
+
+// putUnchecked stores key the way files written before the internal names
+// were reserved could hold it.
+func putUnchecked(tb testing.TB, c *Collection, key, value []byte) {
+	tb.Helper()
+	pos, err := c.locate(key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := c.insertAt(pos, NewItem(key, value)); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestIndexNamesAreReserved(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), nil)
+		if err != nil {
+			return err
+		}
+		name := indexCollectionName([]byte("e"))
+		if err := c.Put(name, []byte("value")); err != reservedNameErr {
+			t.Errorf("putting a reserved key returned %v", err)
+		}
+		if _, err := c.CreateCollection(name, nil); err != reservedNameErr {
+			t.Errorf("creating a collection under a reserved name returned %v", err)
+		}
+		if _, err := c.CreateCollection([]byte("j"), nil); err != nil {
+			return err
+		}
+		if err := c.RenameCollection([]byte("j"), name); err != reservedNameErr {
+			t.Errorf("renaming a collection to a reserved name returned %v", err)
+		}
+
+		putUnchecked(t, c, name, []byte("value"))
+		if _, err := c.CreateIndex([]byte("e"), byCity); err != reservedNameErr {
+			t.Errorf("creating an index whose name is taken returned %v", err)
+		}
+		if index, err := c.Index([]byte("e")); index != nil || err != nil {
+			t.Errorf("the failed index was left behind: %v, %v", index, err)
+		}
+		return nil
+	})
+}
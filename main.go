@@ -9,11 +9,12 @@ func main() {
 
 	tx := db.WriteTx()
 	collectionName := "Users"
-	createdCollection, _ := tx.CreateCollection([]byte(collectionName))
+	createdCollection, _ := tx.CreateCollectionIfNotExists([]byte(collectionName), nil)
+	users := NewTypedCollection(createdCollection, StringCodec{}, StringCodec{})
 
-	newKey := []byte("name")
-	newVal := []byte("Celal")
-	_ = createdCollection.Put(newKey, newVal)
+	newKey := "name"
+	newVal := "Celal"
+	_ = users.Put(newKey, newVal)
 
 	_ = tx.Commit()
 	_ = db.Close()
@@ -21,11 +22,12 @@ func main() {
 	db, _ = Open("minerva.db", &Options{MinFillPercent: 0.5, MaxFillPercent: 1.0})
 	tx = db.ReadTx()
 	createdCollection, _ = tx.GetCollection([]byte(collectionName))
+	users = NewTypedCollection(createdCollection, StringCodec{}, StringCodec{})
 
-	item, _ := createdCollection.Find(newKey)
+	value, _, _ := users.Get(newKey)
 
 	_ = tx.Commit()
 	_ = db.Close()
 
-	fmt.Printf("key is: %s, value is: %s\n", item.key, item.value)
+	fmt.Printf("key is: %s, value is: %s\n", newKey, value)
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"sync"
+)
+
+// MergeOperator combines the value stored under a key with an operand passed
+// to Collection.Merge and returns the new value. existing is nil when the
+// key isn't there.
+type MergeOperator func(existing, operand []byte) ([]byte, error)
+
+var (
+	unknownMergeOperatorErr = errors.New("merge operator is not registered")
+	noMergeOperatorErr      = errors.New("collection has no merge operator")
+	invalidOperandErr       = errors.New("invalid merge operand")
+	blobMergeErr            = errors.New("can't merge into a blob")
+)
+
+// The built-in operators. int64add and max work on 8 byte little-endian
+// int64 values, append concatenates the operand to the value and setunion
+// works on sets encoded with EncodeSet.
+var (
+	mergeOperatorsLock sync.RWMutex
+	mergeOperators     = map[string]MergeOperator{
+		"int64add": int64Add,
+		"max":      int64Max,
+		"append":   appendOperand,
+		"setunion": setUnion,
+	}
+)
+
+// RegisterMergeOperator makes a merge operator available to
+// CollectionOptions under name. Collections only record the name, so it has
+// to be registered again before merging into them after a restart.
+func RegisterMergeOperator(name string, operator MergeOperator) {
+	mergeOperatorsLock.Lock()
+	defer mergeOperatorsLock.Unlock()
+	mergeOperators[name] = operator
+}
+
+func getMergeOperator(name string) (MergeOperator, error) {
+	if name == "" {
+		return nil, noMergeOperatorErr
+	}
+
+	mergeOperatorsLock.RLock()
+	defer mergeOperatorsLock.RUnlock()
+	operator, ok := mergeOperators[name]
+	if !ok {
+		return nil, unknownMergeOperatorErr
+	}
+	return operator, nil
+}
+
+// Merge combines operand into the value stored under key with the merge
+// operator of c, in the same descent that writes the result. The key keeps
+// its expiry time. Blobs can't be merged into.
+func (c *Collection) Merge(key, operand []byte) error {
+	operator, err := getMergeOperator(c.meta.MergeOperator)
+	if err != nil {
+		return err
+	}
+	_, err = c.merge(key, operand, operator)
+	return err
+}
+
+// Increment adds delta to the int64 stored under key, starting from zero,
+// and returns the new value. It works whatever the merge operator of c is.
+func (c *Collection) Increment(key []byte, delta int64) (int64, error) {
+	value, err := c.merge(key, binary.LittleEndian.AppendUint64(nil, uint64(delta)), int64Add)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(value)), nil
+}
+
+func (c *Collection) merge(key, operand []byte, operator MergeOperator) ([]byte, error) {
+	item, err := c.rewrite(key, func(current *Item) ([]byte, bool, error) {
+		var existing []byte
+		if current != nil {
+			if current.isCollection() {
+				return nil, false, incompatibleValueErr
+			}
+			if current.isBlob() {
+				return nil, false, blobMergeErr
+			}
+			existing = current.value
+		}
+		value, err := operator(existing, operand)
+		return value, err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item.plainValue(), nil
+}
+
+func int64Add(existing, operand []byte) ([]byte, error) {
+	a, b, err := int64Operands(existing, operand)
+	if err != nil {
+		return nil, err
+	}
+	return binary.LittleEndian.AppendUint64(nil, uint64(a+b)), nil
+}
+
+func int64Max(existing, operand []byte) ([]byte, error) {
+	a, b, err := int64Operands(existing, operand)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && a > b {
+		b = a
+	}
+	return binary.LittleEndian.AppendUint64(nil, uint64(b)), nil
+}
+
+func int64Operands(existing, operand []byte) (int64, int64, error) {
+	if len(operand) != 8 || existing != nil && len(existing) != 8 {
+		return 0, 0, invalidOperandErr
+	}
+	var a int64
+	if existing != nil {
+		a = int64(binary.LittleEndian.Uint64(existing))
+	}
+	return a, int64(binary.LittleEndian.Uint64(operand)), nil
+}
+
+func appendOperand(existing, operand []byte) ([]byte, error) {
+	return append(append([]byte{}, existing...), operand...), nil
+}
+
+func setUnion(existing, operand []byte) ([]byte, error) {
+	a, err := DecodeSet(existing)
+	if err != nil {
+		return nil, err
+	}
+	b, err := DecodeSet(operand)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeSet(append(a, b...)), nil
+}
+
+// EncodeSet encodes members as a set for the setunion merge operator: sorted,
+// without duplicates, each prefixed with its two byte length.
+func EncodeSet(members [][]byte) []byte {
+	members = slices.Clone(members)
+	slices.SortFunc(members, bytes.Compare)
+	members = slices.CompactFunc(members, bytes.Equal)
+
+	var b []byte
+	for _, member := range members {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(member)))
+		b = append(b, member...)
+	}
+	return b
+}
+
+// DecodeSet returns the members of a set encoded with EncodeSet.
+func DecodeSet(b []byte) ([][]byte, error) {
+	var members [][]byte
+	for pos := 0; pos < len(b); {
+		if pos+2 > len(b) {
+			return nil, invalidOperandErr
+		}
+		size := int(binary.LittleEndian.Uint16(b[pos:]))
+		pos += 2
+		if pos+size > len(b) {
+			return nil, invalidOperandErr
+		}
+		members = append(members, b[pos:pos+size])
+		pos += size
+	}
+	return members, nil
+}
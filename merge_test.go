@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func int64Value(v int64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(v))
+}
+
+func TestMergeOperators(t *testing.T) {
+	RegisterMergeOperator("test-upper", func(existing, operand []byte) ([]byte, error) {
+		return bytes.ToUpper(append(append([]byte{}, existing...), operand...)), nil
+	})
+	tests := []struct {
+		operator string
+		operands [][]byte
+		want     []byte
+	}{
+		{"int64add", [][]byte{int64Value(5), int64Value(-7), int64Value(10)}, int64Value(8)},
+		{"max", [][]byte{int64Value(-5), int64Value(3), int64Value(1)}, int64Value(3)},
+		{"append", [][]byte{[]byte("ab"), []byte("cd")}, []byte("abcd")},
+		{"setunion", [][]byte{
+			EncodeSet([][]byte{[]byte("b"), []byte("a")}),
+			EncodeSet([][]byte{[]byte("c"), []byte("a")}),
+		}, EncodeSet([][]byte{[]byte("a"), []byte("b"), []byte("c")})},
+		{"test-upper", [][]byte{[]byte("ab"), []byte("cd")}, []byte("ABCD")},
+	}
+	for _, test := range tests {
+		t.Run(test.operator, func(t *testing.T) {
+			db := openTestDB(t, nil)
+			update(t, db, func(tx *Tx) error {
+				c, err := tx.CreateCollection([]byte("c"), &CollectionOptions{MergeOperator: test.operator})
+				if err != nil {
+					return err
+				}
+				for _, operand := range test.operands {
+					if err := c.Merge([]byte("key"), operand); err != nil {
+						return err
+					}
+				}
+				if value, err := c.Get([]byte("key")); err != nil || !bytes.Equal(value, test.want) {
+					t.Errorf("merged into %x, %v, want %x", value, err, test.want)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestMergeErrors(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		plain, err := tx.CreateCollection([]byte("plain"), nil)
+		if err != nil {
+			return err
+		}
+		if err := plain.Merge([]byte("key"), []byte("x")); err != noMergeOperatorErr {
+			t.Errorf("Merge without an operator returned %v, want %v", err, noMergeOperatorErr)
+		}
+		unknown, err := tx.CreateCollection([]byte("unknown"), &CollectionOptions{MergeOperator: "test-missing"})
+		if err != nil {
+			return err
+		}
+		if err := unknown.Merge([]byte("key"), []byte("x")); err != unknownMergeOperatorErr {
+			t.Errorf("Merge with an unknown operator returned %v, want %v", err, unknownMergeOperatorErr)
+		}
+
+		c, err := tx.CreateCollection([]byte("c"), &CollectionOptions{MergeOperator: "int64add"})
+		if err != nil {
+			return err
+		}
+		if err := c.Merge([]byte("key"), []byte("short")); err != invalidOperandErr {
+			t.Errorf("Merge of a bad operand returned %v, want %v", err, invalidOperandErr)
+		}
+		if _, err := c.CreateCollection([]byte("child"), nil); err != nil {
+			return err
+		}
+		if err := c.Merge([]byte("child"), int64Value(1)); err != incompatibleValueErr {
+			t.Errorf("Merge into a collection returned %v, want %v", err, incompatibleValueErr)
+		}
+
+		blob := strings.Repeat("x", 10000)
+		if err := c.PutReader([]byte("blob"), strings.NewReader(blob), int64(len(blob))); err != nil {
+			return err
+		}
+		if err := c.Merge([]byte("blob"), int64Value(1)); err != blobMergeErr {
+			t.Errorf("Merge into a blob returned %v, want %v", err, blobMergeErr)
+		}
+		if ok, err := c.CompareAndSwap([]byte("blob"), nil, []byte("x")); err != nil || ok {
+			t.Errorf("CompareAndSwap of a blob returned %v, %v, want false", ok, err)
+		}
+		return nil
+	})
+}
+
+func TestIncrement(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		// Increment works whatever the merge operator.
+		c, err := tx.CreateCollection([]byte("c"), &CollectionOptions{MergeOperator: "append"})
+		if err != nil {
+			return err
+		}
+		var got []int64
+		for _, delta := range []int64{1, 1, 40, -2} {
+			value, err := c.Increment([]byte("counter"), delta)
+			if err != nil {
+				return err
+			}
+			got = append(got, value)
+		}
+		if fmt.Sprint(got) != "[1 2 42 40]" {
+			t.Errorf("Increment returned %v, want [1 2 42 40]", got)
+		}
+		return nil
+	})
+}
+
+func TestRewritesKeepTheExpiry(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), &CollectionOptions{MergeOperator: "append", TTL: time.Minute})
+		if err != nil {
+			return err
+		}
+		for _, key := range []string{"merged", "swapped", "updated"} {
+			if err := c.PutWithTTL([]byte(key), []byte("a"), time.Hour); err != nil {
+				return err
+			}
+		}
+		if err := c.Merge([]byte("merged"), []byte("b")); err != nil {
+			return err
+		}
+		if ok, err := c.CompareAndSwap([]byte("swapped"), []byte("a"), []byte("b")); err != nil || !ok {
+			t.Errorf("CompareAndSwap returned %v, %v", ok, err)
+		}
+		cursor := c.Cursor()
+		if _, err := cursor.Seek([]byte("updated")); err != nil {
+			return err
+		}
+		if err := cursor.Update([]byte("b")); err != nil {
+			return err
+		}
+		// New keys get the default TTL of the collection.
+		if err := c.Merge([]byte("new"), []byte("b")); err != nil {
+			return err
+		}
+
+		for key, ttl := range map[string]time.Duration{"merged": time.Hour, "swapped": time.Hour, "updated": time.Hour, "new": time.Minute} {
+			item, err := c.find([]byte(key))
+			if err != nil {
+				return err
+			}
+			if !item.isExpiring() {
+				t.Errorf("%s doesn't expire", key)
+				continue
+			}
+			if left := time.Until(item.expiresAt()); left < ttl-time.Second || left > ttl {
+				t.Errorf("%s expires in %v, want %v", key, left, ttl)
+			}
+		}
+		if n := ttlEntries(t, tx); n != 4 {
+			t.Errorf("%d ttl entries, want 4", n)
+		}
+		return nil
+	})
+}
@@ -1,22 +1,48 @@
 package main
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"errors"
+	"maps"
+	"slices"
+)
 
 const (
 	metaPageNumber = 0
 	pageNumberSize = 8
 	nodeHeaderSize = 3
+	itemHeaderSize = 7
 	magicNumber uint32 = 0xD00DB00D
 	magicNumberSize = 4
+	txidSize = 8
+
+	// formatVersion is bumped whenever the layout of nodes, the freelist
+	// or the meta page changes. Files written before the version was
+	// recorded read it as 0.
+	formatVersion uint32 = 1
+	formatVersionSize = 4
+)
+
+var (
+	notADatabaseErr      = errors.New("the file is not a libra db file")
+	unsupportedFormatErr = errors.New("the file format version is not supported")
 )
 
 type meta struct {
 	root pageNumber
 	freeListPage pageNumber
+
+	// txid is the ID of the last committed write transaction.
+	txid uint64
+
+	// comparators counts the collections created with each comparator, so
+	// Open only has to check that those names are registered. It is nil for
+	// files written before the collections were counted.
+	comparators map[string]uint64
 }
 
 func newMeta() *meta {
-	return &meta{}
+	return &meta{comparators: map[string]uint64{}}
 }
 
 func (m *meta) serialize(buf []byte) {
@@ -29,14 +55,35 @@ func (m *meta) serialize(buf []byte) {
 
 	binary.LittleEndian.PutUint64(buf[pos:], uint64(m.freeListPage))
 	pos += pageNumberSize
+
+	binary.LittleEndian.PutUint64(buf[pos:], m.txid)
+	pos += txidSize
+
+	binary.LittleEndian.PutUint32(buf[pos:], formatVersion)
+	pos += formatVersionSize
+
+	if m.comparators == nil {
+		return
+	}
+	buf[pos] = 1
+	pos += 1
+	binary.LittleEndian.PutUint16(buf[pos:], uint16(len(m.comparators)))
+	pos += 2
+	for _, name := range slices.Sorted(maps.Keys(m.comparators)) {
+		binary.LittleEndian.PutUint16(buf[pos:], uint16(len(name)))
+		pos += 2
+		pos += copy(buf[pos:], name)
+		binary.LittleEndian.PutUint64(buf[pos:], m.comparators[name])
+		pos += 8
+	}
 }
-func (m *meta) deserialize(buf []byte) {
+func (m *meta) deserialize(buf []byte) error {
 	pos := 0
 	magicNumberRes := binary.LittleEndian.Uint32(buf[pos:])
 	pos += magicNumberSize
 
 	if magicNumberRes != magicNumber {
-		panic("The file is not a libra db file")
+		return notADatabaseErr
 	}
 
 	m.root = pageNumber(binary.LittleEndian.Uint64(buf[pos:]))
@@ -44,4 +91,30 @@ func (m *meta) deserialize(buf []byte) {
 
 	m.freeListPage = pageNumber(binary.LittleEndian.Uint64(buf[pos:]))
 	pos += pageNumberSize
+
+	m.txid = binary.LittleEndian.Uint64(buf[pos:])
+	pos += txidSize
+
+	if binary.LittleEndian.Uint32(buf[pos:]) != formatVersion {
+		return unsupportedFormatErr
+	}
+	pos += formatVersionSize
+
+	m.comparators = nil
+	if buf[pos] == 0 {
+		return nil
+	}
+	pos += 1
+	m.comparators = map[string]uint64{}
+	count := int(binary.LittleEndian.Uint16(buf[pos:]))
+	pos += 2
+	for range count {
+		size := int(binary.LittleEndian.Uint16(buf[pos:]))
+		pos += 2
+		name := string(buf[pos : pos+size])
+		pos += size
+		m.comparators[name] = binary.LittleEndian.Uint64(buf[pos:])
+		pos += 8
+	}
+	return nil
 }
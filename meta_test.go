@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenChecksTheFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDBAt(t, path, nil)
+	_ = db.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versionAt := magicNumberSize + 2*pageNumberSize + txidSize
+
+	tests := []struct {
+		name   string
+		change func(page []byte)
+		want   error
+	}{
+		{"other file", func(page []byte) { copy(page, "not a database") }, notADatabaseErr},
+		{"newer version", func(page []byte) {
+			binary.LittleEndian.PutUint32(page[versionAt:], formatVersion+1)
+		}, unsupportedFormatErr},
+		{"no version", func(page []byte) {
+			binary.LittleEndian.PutUint32(page[versionAt:], 0)
+		}, unsupportedFormatErr},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changed := append([]byte{}, data...)
+			test.change(changed)
+			path := filepath.Join(t.TempDir(), "test.db")
+			if err := os.WriteFile(path, changed, 0666); err != nil {
+				t.Fatal(err)
+			}
+			options := *DefaultOptions
+			options.ReapInterval = 0
+			if db, err := Open(path, &options); err != test.want {
+				if err == nil {
+					_ = db.Close()
+				}
+				t.Errorf("Open returned %v, want %v", err, test.want)
+			}
+		})
+	}
+}
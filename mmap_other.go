@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// mmapFile maps nothing where mmap isn't available, which leaves every page
+// to be read from the file.
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return nil, nil
+}
+
+func munmap(data []byte) error {
+	return nil
+}
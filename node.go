@@ -1,13 +1,34 @@
 package main
 
 import (
-	"bytes"
 	"encoding/binary"
 )
 
+const (
+	collectionItemFlag uint8 = 1 << iota
+	internalItemFlag
+	expiringItemFlag
+	blobItemFlag
+)
+
+// Item is a key and value read from a collection. Its bytes point into the
+// page they were read from, so Key and Value are only valid until the
+// transaction ends; CopyKey and CopyValue return copies that can be kept.
+//
+// The check is best-effort. Using Key or Value later panics when the file
+// is mapped, where the page may have been unmapped or reused. Items of a
+// file that isn't mapped aren't tied to their transaction, so lookups don't
+// allocate, and nothing stops them from being used after it; their bytes
+// are left alone, but callers must not count on that.
 type Item struct {
 	key   []byte
 	value []byte
+	flags uint8
+
+	// tx is the transaction that handed out the item when the file is
+	// mapped, nil otherwise and for items that didn't come from a
+	// collection.
+	tx *Tx
 }
 
 type Node struct {
@@ -35,6 +56,50 @@ func NewItem(key []byte, value []byte) *Item {
 	}
 }
 
+func (i *Item) Key() []byte {
+	i.checkLifetime()
+	return i.key
+}
+
+func (i *Item) Value() []byte {
+	i.checkLifetime()
+	return i.value
+}
+
+func (i *Item) CopyKey() []byte {
+	return append([]byte{}, i.Key()...)
+}
+
+func (i *Item) CopyValue() []byte {
+	return append([]byte{}, i.Value()...)
+}
+
+// checkLifetime panics if the transaction that returned i has ended and the
+// page i points into may have been reused.
+func (i *Item) checkLifetime() {
+	if i.tx != nil && i.tx.closed {
+		panic(itemOutlivedTxErr)
+	}
+}
+
+func (i *Item) isCollection() bool {
+	return i.flags&collectionItemFlag != 0
+}
+
+// IsCollection reports whether i is the header of a nested collection, which
+// cursors return without a value; GetCollection opens it.
+func (i *Item) IsCollection() bool {
+	return i.isCollection()
+}
+
+func (i *Item) isInternal() bool {
+	return i.flags&internalItemFlag != 0
+}
+
+func (i *Item) isExpiring() bool {
+	return i.flags&expiringItemFlag != 0
+}
+
 func isLast(index int, parentNode *Node) bool {
 	return index == len(parentNode.items)
 }
@@ -103,21 +168,24 @@ func (n *Node) serialize(buf []byte) []byte {
 		klen := len(item.key)
 		vlen := len(item.value)
 
-		offset := rightPos - klen - vlen - 2
+		offset := rightPos - klen - vlen - 5
 		binary.LittleEndian.PutUint16(buf[leftPos:], uint16(offset))
 		leftPos += 2
 
 		rightPos -= vlen
 		copy(buf[rightPos:], item.value)
 
-		rightPos -= 1
-		buf[rightPos] = byte(vlen)
+		rightPos -= 2
+		binary.LittleEndian.PutUint16(buf[rightPos:], uint16(vlen))
 
 		rightPos -= klen
 		copy(buf[rightPos:], item.key)
 
+		rightPos -= 2
+		binary.LittleEndian.PutUint16(buf[rightPos:], uint16(klen))
+
 		rightPos -= 1
-		buf[rightPos] = byte(klen)
+		buf[rightPos] = item.flags
 	}
 
 	if !isLeaf {
@@ -146,18 +214,21 @@ func (n *Node) deserialize(buf []byte) {
 		offset := binary.LittleEndian.Uint16(buf[leftPos:])
 		leftPos += 2
 
-		klen := uint16(buf[int(offset)])
+		flags := buf[offset]
 		offset += 1
 
+		klen := binary.LittleEndian.Uint16(buf[offset:])
+		offset += 2
+
 		key := buf[offset : offset+klen]
 		offset += klen
 
-		vlen := uint16(buf[int(offset)])
-		offset += 1
+		vlen := binary.LittleEndian.Uint16(buf[offset:])
+		offset += 2
 
 		value := buf[offset : offset+vlen]
 		offset += vlen
-		n.items = append(n.items, NewItem(key, value))
+		n.items = append(n.items, &Item{key: key, value: value, flags: flags})
 	}
 
 	if isLeaf == 0 { 
@@ -167,10 +238,17 @@ func (n *Node) deserialize(buf []byte) {
 }
 
 func (n *Node) elementSize(i int) int {
+	return itemSize(n.items[i])
+}
+
+// itemSize is the room item takes up in a node, the pointer to the child
+// before it included.
+func itemSize(item *Item) int {
 	size := 0
-	size += len(n.items[i].key)
-	size += len(n.items[i].value)
-	size += pageNumberSize 
+	size += len(item.key)
+	size += len(item.value)
+	size += itemHeaderSize
+	size += pageNumberSize
 	return size
 }
 func (n *Node) nodeSize() int {
@@ -186,48 +264,44 @@ func (n *Node) nodeSize() int {
 }
 
 
-func (n *Node) findKey(key []byte, exact bool) (int, *Node, []int ,error) {
-	ancestorsIndexes := []int{0} 
-	index, node, err := findKeyHelper(n, key, exact, &ancestorsIndexes)
-	if err != nil {
-		return -1, nil, nil, err
-	}
-	return index, node, ancestorsIndexes, nil
-}
-
-func findKeyHelper(node *Node, key []byte, exact bool, ancestorsIndexes *[]int) (int, *Node ,error) {
-	wasFound, index := node.findKeyInNode(key)
-	if wasFound {
-		return index, node, nil
-	}
-
-	if node.isLeaf() {
-		if exact {
-			return -1, nil, nil
+// findKey descends from n to the node that holds key or would take it,
+// recording the child indexes on the way for the write that follows. Reads
+// go through Collection.find, which records nothing.
+func (n *Node) findKey(key []byte, compare Comparator) (int, *Node, []int ,error) {
+	ancestorsIndexes := []int{0}
+	node := n
+	for {
+		wasFound, index := node.findKeyInNode(key, compare)
+		if wasFound || node.isLeaf() {
+			return index, node, ancestorsIndexes, nil
 		}
-		return index, node, nil
-	}
 
-	*ancestorsIndexes = append(*ancestorsIndexes, index)
-	nextChild, err := node.getNode(node.childNodes[index])
-	if err != nil {
-		return -1, nil, err
+		ancestorsIndexes = append(ancestorsIndexes, index)
+		nextChild, err := node.getNode(node.childNodes[index])
+		if err != nil {
+			return -1, nil, nil, err
+		}
+		node = nextChild
 	}
-	return findKeyHelper(nextChild, key, exact, ancestorsIndexes)
 }
-func (n *Node) findKeyInNode(key []byte) (bool, int) {
-	for i, existingItem := range n.items {
-		res := bytes.Compare(existingItem.key, key)
-		if res == 0 { 
-			return true, i
-		}
 
-		if res == 1 {
-			return false, i
+// findKeyInNode binary searches the items of n for key and returns whether
+// it is there and the index of the first item that isn't less than it.
+func (n *Node) findKeyInNode(key []byte, compare Comparator) (bool, int) {
+	lo, hi := 0, len(n.items)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		res := compare(n.items[mid].key, key)
+		if res == 0 {
+			return true, mid
+		}
+		if res < 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
 		}
 	}
-
-	return false, len(n.items)
+	return false, lo
 }
 
 func (n *Node) addItem(item *Item, insertionIndex int) int {
@@ -242,18 +316,26 @@ func (n *Node) addItem(item *Item, insertionIndex int) int {
 }
 
 
+// split moves the items of nodeToSplit, the child of n at nodeToSplitIndex,
+// past the split index to a new node and the item at the index up into n.
+// An overpopulated node holds at least three items since no item takes up
+// more than half a node, so both halves keep an item.
 func (n *Node) split(nodeToSplit *Node, nodeToSplitIndex int) {
 	splitIndex := nodeToSplit.tx.db.getSplitIndex(nodeToSplit)
+	if splitIndex == -1 {
+		// Only the last item takes the node past the minimum size.
+		splitIndex = len(nodeToSplit.items) - 2
+	}
 	middleItem := nodeToSplit.items[splitIndex]
 	var newNode *Node
 
 	if nodeToSplit.isLeaf() {
 		newNode = n.writeNode(n.tx.newNode(nodeToSplit.items[splitIndex+1:], []pageNumber{}))
-		nodeToSplit.items = nodeToSplit.items[:splitIndex]
+		nodeToSplit.items = nodeToSplit.items[:splitIndex:splitIndex]
 	} else {
 		newNode = n.writeNode(n.tx.newNode(nodeToSplit.items[splitIndex+1:], nodeToSplit.childNodes[splitIndex+1:]))
-		nodeToSplit.items = nodeToSplit.items[:splitIndex]
-		nodeToSplit.childNodes = nodeToSplit.childNodes[:splitIndex+1]
+		nodeToSplit.items = nodeToSplit.items[:splitIndex:splitIndex]
+		nodeToSplit.childNodes = nodeToSplit.childNodes[:splitIndex+1 : splitIndex+1]
 	}
 	n.addItem(middleItem, nodeToSplitIndex)
 	if len(n.childNodes) == nodeToSplitIndex+1 { 
@@ -281,8 +363,8 @@ func (n *Node) removeItemFromInternal(index int) ([]int, error) {
 	}
 
 	for !aNode.isLeaf() {
-		traversingIndex := len(n.childNodes) - 1
-		aNode, err = n.getNode(n.childNodes[traversingIndex])
+		traversingIndex := len(aNode.childNodes) - 1
+		aNode, err = n.getNode(aNode.childNodes[traversingIndex])
 		if err != nil {
 			return nil, err
 		}
@@ -351,10 +433,33 @@ func (n *Node) merge(bNode *Node, bNodeIndex int) error {
 		aNode.childNodes = append(aNode.childNodes, bNode.childNodes...)
 	}
 	n.writeNodes(aNode, n)
-	n.tx.db.deleteNode(bNode.pageNum)
+	n.tx.deleteNode(bNode)
+	n.splitOverpopulated(aNode, bNodeIndex-1)
 	return nil
 }
 
+// splitOverpopulated splits child, the child of n at index, if it outgrew
+// its page, and again the halves that still don't fit. Merging two nodes
+// can make one more than two pages large.
+func (n *Node) splitOverpopulated(child *Node, index int) {
+	if !child.isOverPopulated() {
+		return
+	}
+	n.split(child, index)
+	n.splitOverpopulated(n.tx.dirtyNodes[n.childNodes[index+1]], index+1)
+	n.splitOverpopulated(child, index)
+}
+
+// splitOverpopulatedChildren splits the children of n that were modified in
+// this transaction and no longer fit in a page.
+func (n *Node) splitOverpopulatedChildren() {
+	for i := 0; i < len(n.childNodes); i++ {
+		if child, ok := n.tx.dirtyNodes[n.childNodes[i]]; ok {
+			n.splitOverpopulated(child, i)
+		}
+	}
+}
+
 
 func (n *Node) rebalanceRemove(unbalancedNode *Node, unbalancedNodeIndex int) error {
 	pNode := n
@@ -367,6 +472,7 @@ func (n *Node) rebalanceRemove(unbalancedNode *Node, unbalancedNodeIndex int) er
 		if leftNode.canSpareAnElement() {
 			rotateRight(leftNode, pNode, unbalancedNode, unbalancedNodeIndex)
 			n.writeNodes(leftNode, pNode, unbalancedNode)
+			n.splitOverpopulated(unbalancedNode, unbalancedNodeIndex)
 			return nil
 		}
 	}
@@ -379,6 +485,7 @@ func (n *Node) rebalanceRemove(unbalancedNode *Node, unbalancedNodeIndex int) er
 		if rightNode.canSpareAnElement() {
 			rotateLeft(unbalancedNode, pNode, rightNode, unbalancedNodeIndex)
 			n.writeNodes(unbalancedNode, pNode, rightNode)
+			n.splitOverpopulated(unbalancedNode, unbalancedNodeIndex)
 			return nil
 		}
 	}
@@ -0,0 +1,86 @@
+package main
+
+import "errors"
+
+var ErrQuotaExceeded = errors.New("collection quota exceeded")
+
+// CollectionUsage is what the items of a collection count against its
+// quota. Nested collections are not part of it.
+type CollectionUsage struct {
+	Items uint64
+	Bytes uint64
+}
+
+// Usage returns the number of items in c and the size of their keys and
+// values.
+func (c *Collection) Usage() (CollectionUsage, error) {
+	if err := c.loadUsage(); err != nil {
+		return CollectionUsage{}, err
+	}
+	return c.usage, nil
+}
+
+func itemUsage(item *Item) CollectionUsage {
+	if item == nil || item.isCollection() {
+		return CollectionUsage{}
+	}
+	if item.isBlob() {
+		return CollectionUsage{1, uint64(len(item.key)) + item.blobSize()}
+	}
+	return CollectionUsage{1, uint64(len(item.key) + len(item.plainValue()))}
+}
+
+// loadUsage counts the items of a collection whose header was written before
+// usage was tracked. It has to run before c is modified.
+func (c *Collection) loadUsage() error {
+	if c.usageKnown {
+		return nil
+	}
+
+	var usage CollectionUsage
+	cursor := c.Cursor()
+	item, err := cursor.first()
+	for ; item != nil; item, err = cursor.next() {
+		u := itemUsage(item)
+		usage.Items += u.Items
+		usage.Bytes += u.Bytes
+	}
+	if err != nil {
+		return err
+	}
+
+	c.usage = usage
+	c.usageKnown = true
+	c.dirty = c.dirty || c.tx.write
+	return nil
+}
+
+// checkQuota fails with ErrQuotaExceeded if replacing old with item would
+// take c over one of its limits. Writes that don't add to the usage are
+// always allowed, so a collection over a lowered limit can still shrink.
+func (c *Collection) checkQuota(old *Item, item *Item) error {
+	if c.meta.MaxItems == 0 && c.meta.MaxBytes == 0 {
+		return nil
+	}
+
+	added, removed := itemUsage(item), itemUsage(old)
+	if c.meta.MaxItems != 0 && added.Items > removed.Items && c.usage.Items+added.Items-removed.Items > c.meta.MaxItems {
+		return ErrQuotaExceeded
+	}
+	if c.meta.MaxBytes != 0 && added.Bytes > removed.Bytes && c.usage.Bytes+added.Bytes-removed.Bytes > c.meta.MaxBytes {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// track updates the usage of c after old was replaced by item. Either of
+// them may be nil.
+func (c *Collection) track(old *Item, item *Item) {
+	added, removed := itemUsage(item), itemUsage(old)
+	if added == removed {
+		return
+	}
+	c.usage.Items += added.Items - removed.Items
+	c.usage.Bytes += added.Bytes - removed.Bytes
+	c.dirty = true
+}
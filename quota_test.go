@@ -0,0 +1,77 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQuotas(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDBAt(t, path, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), &CollectionOptions{MaxItems: 3, MaxBytes: 100})
+		if err != nil {
+			return err
+		}
+		for _, key := range []string{"a", "b", "c"} {
+			if err := c.Put([]byte(key), []byte("12345")); err != nil {
+				return err
+			}
+		}
+		if err := c.Put([]byte("d"), []byte("12345")); err != ErrQuotaExceeded {
+			t.Errorf("Put of a fourth item returned %v, want %v", err, ErrQuotaExceeded)
+		}
+		// Replacing an item doesn't add one.
+		if err := c.Put([]byte("a"), []byte("1234567890")); err != nil {
+			t.Errorf("replacing an item returned %v", err)
+		}
+		if err := c.Put([]byte("b"), make([]byte, 100)); err != ErrQuotaExceeded {
+			t.Errorf("Put over the byte limit returned %v, want %v", err, ErrQuotaExceeded)
+		}
+		// Nested collections don't count.
+		if _, err := c.CreateCollection([]byte("child"), nil); err != nil {
+			t.Errorf("creating a nested collection returned %v", err)
+		}
+		return nil
+	})
+	_ = db.Close()
+
+	db = openTestDBAt(t, path, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		usage, err := c.Usage()
+		if err != nil {
+			return err
+		}
+		if usage != (CollectionUsage{3, 23}) {
+			t.Errorf("usage is %+v after reopening, want 3 items and 23 bytes", usage)
+		}
+
+		if err := c.DeleteRange([]byte("a"), []byte("c")); err != nil {
+			return err
+		}
+		if usage, err := c.Usage(); err != nil || usage != (CollectionUsage{1, 6}) {
+			t.Errorf("usage is %+v, %v after DeleteRange, want 1 item and 6 bytes", usage, err)
+		}
+		blob := strings.Repeat("x", 10000)
+		if err := c.PutReader([]byte("blob"), strings.NewReader(blob), int64(len(blob))); err != ErrQuotaExceeded {
+			t.Errorf("PutReader over the byte limit returned %v, want %v", err, ErrQuotaExceeded)
+		}
+
+		// A collection over a lowered limit can still shrink.
+		meta := c.Meta()
+		meta.MaxItems = 0
+		meta.MaxBytes = 1
+		if err := tx.SetCollectionMeta([]byte("c"), meta); err != nil {
+			return err
+		}
+		if err := c.Put([]byte("c"), []byte("1")); err != nil {
+			t.Errorf("shrinking an item over the limit returned %v", err)
+		}
+		return c.Remove([]byte("c"))
+	})
+}
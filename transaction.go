@@ -1,8 +1,14 @@
 package main
 
-import "errors"
+import (
+	"errors"
+	"iter"
+)
 
-var writeInsideReadTxErr = errors.New("can't perform a write operation inside a read transaction")
+var (
+	writeInsideReadTxErr = errors.New("can't perform a write operation inside a read transaction")
+	itemOutlivedTxErr    = errors.New("item used after its transaction ended")
+)
 
 type Tx struct {
 	dirtyNodes     map[pageNumber]*Node
@@ -10,9 +16,30 @@ type Tx struct {
 	allocatedPages []pageNumber
 	write          bool
 	db             *DB
+	mutations      uint64
+	rootCollection *Collection
+
+	// renamedPaths records the collection renames whose index extractors
+	// have to be moved back on rollback.
+	renamedPaths [][2][][]byte
+
+	// closed is set once the transaction is committed or rolled back.
+	closed bool
+
+	// id is the ID a write transaction commits as. A read transaction has
+	// the ID of the last write it sees.
+	id uint64
+
+	// comparators holds how many collections created with each comparator
+	// the transaction added or dropped, for the meta page.
+	comparators map[string]int
 }
 
 func NewTx(db *DB, write bool) *Tx {
+	id := db.txid
+	if write {
+		id++
+	}
 
 	return &Tx{
 		map[pageNumber]*Node{},
@@ -20,13 +47,24 @@ func NewTx(db *DB, write bool) *Tx {
 		make([]pageNumber, 0),
 		write,
 		db,
+		0,
+		nil,
+		nil,
+		false,
+		id,
+		nil,
 	}
 }
 
+func (tx *Tx) ID() uint64 {
+	return tx.id
+}
+
 
 
 func (tx *Tx) Rollback() {
 
+	tx.closed = true
 	if !tx.write {
 		tx.db.rwlock.RUnlock()
 		return
@@ -37,6 +75,9 @@ func (tx *Tx) Rollback() {
 			tx.db.freeList.releasePage(page)
 		}
 		tx.allocatedPages = nil
+		for i := len(tx.renamedPaths) - 1; i >= 0; i-- {
+			tx.db.moveExtractors(tx.renamedPaths[i][1], tx.renamedPaths[i][0])
+		}
 		tx.db.rwlock.Unlock()
 	}
 
@@ -44,15 +85,22 @@ func (tx *Tx) Rollback() {
 
 func (tx *Tx) Commit() error {
 	if !tx.write {
+		tx.closed = true
 		tx.db.rwlock.RUnlock()
 		return nil
 	}
 
+	rootCollection := tx.getRootCollection()
+	if err := rootCollection.flush(); err != nil {
+		return err
+	}
+
+	nodes := make([]*Node, 0, len(tx.dirtyNodes))
 	for _, node := range tx.dirtyNodes {
-		_, err := tx.db.writeNode(node)
-		if err != nil {
-			return err
-		}
+		nodes = append(nodes, node)
+	}
+	if err := tx.db.writeNodes(nodes); err != nil {
+		return err
 	}
 
 	for _, pageNum := range tx.pagesToDelete {
@@ -63,11 +111,24 @@ func (tx *Tx) Commit() error {
 		return err
 	}
 
+	// Any write moves the transaction ID on, even one that leaves the root
+	// where it was.
+	if rootCollection.dirty || len(tx.dirtyNodes) != 0 {
+		tx.db.root = rootCollection.root
+		tx.db.txid = tx.id
+		tx.db.countComparators(tx.comparators)
+		if _, err := tx.db.writeMeta(tx.db.meta); err != nil {
+			return err
+		}
+	}
+
 	tx.dirtyNodes = nil
 	tx.pagesToDelete = nil
 	tx.allocatedPages = nil
+	tx.closed = true
+	err = tx.db.remap()
 	tx.db.rwlock.Unlock()
-	return nil
+	return err
 }
 
 func (tx *Tx) newNode(items []*Item, childNodes []pageNumber) *Node {
@@ -93,80 +154,101 @@ func (tx *Tx) getNode(pageNum pageNumber) (*Node, error) {
 	return node, nil
 }
 
+// readNode is getNode for callers that only read the node. It may return a
+// node shared with the cache, which must not be changed.
+func (tx *Tx) readNode(pageNum pageNumber) (*Node, error) {
+	if node, ok := tx.dirtyNodes[pageNum]; ok {
+		return node, nil
+	}
+	return tx.db.readNode(pageNum)
+}
+
 func (tx *Tx) writeNode(node *Node) *Node {
+	tx.mutations++
 	tx.dirtyNodes[node.pageNum] = node
 	node.tx = tx
 	return node
 }
 
 func (tx *Tx) deleteNode(node *Node) {
+	tx.mutations++
+	delete(tx.dirtyNodes, node.pageNum)
 	tx.pagesToDelete = append(tx.pagesToDelete, node.pageNum)
 }
 
-
-func (tx *Tx) getRootCollection() *Collection {
-	rootCollection := newEmptyCollection()
-	rootCollection.root =tx.db.root
-	rootCollection.tx = tx
-	return rootCollection
-}
-
-func (tx *Tx) GetCollection(name []byte) (*Collection, error) {
-	rootCollection:=tx.getRootCollection()
-	item,err := rootCollection.Find(name)
-
+// releaseTree frees every page of the tree rooted at pageNum, including the
+// trees of collections nested in it.
+func (tx *Tx) releaseTree(pageNum pageNumber) error {
+	node, err := tx.getNode(pageNum)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	if err == nil {
-		return nil, nil
+	for _, item := range node.items {
+		if err := tx.releaseItem(item); err != nil {
+			return err
+		}
 	}
-
-	collection := newEmptyCollection()
-	collection.deserialize(item)
-	collection.tx = tx
-	return collection, nil
+	for _, child := range node.childNodes {
+		if err := tx.releaseTree(child); err != nil {
+			return err
+		}
+	}
+	tx.deleteNode(node)
+	return nil
 }
 
-
-func (tx *Tx) CreateCollection(name []byte) (*Collection, error){
-	if !tx.write{
-		return nil, writeInsideReadTxErr
+// releaseItem frees the pages an item owns outside of the node holding it.
+func (tx *Tx) releaseItem(item *Item) error {
+	if item.isBlob() {
+		return tx.releaseBlob(item)
 	}
-	
-	newCollectionPage,err:= tx.db.writeNode(NewNode())
-	if err != nil {
-		return nil, err
+	if !item.isCollection() {
+		return nil
 	}
+	collection := newEmptyCollection()
+	if err := collection.deserialize(item); err != nil {
+		return err
+	}
+	tx.countComparator(collection.meta.Comparator, -1)
+	return tx.releaseTree(collection.root)
+}
 
-	newCollection := newEmptyCollection()
-	newCollection.name = name
-	newCollection.root = newCollectionPage.pageNum
-	return tx.createCollection(newCollection)
 
-	
+func (tx *Tx) getRootCollection() *Collection {
+	if tx.rootCollection == nil {
+		tx.rootCollection = newEmptyCollection()
+		tx.rootCollection.root = tx.db.root
+		tx.rootCollection.tx = tx
+	}
+	return tx.rootCollection
 }
 
-func (tx *Tx) createCollection(collection *Collection) (*Collection, error) {
-	collection.tx = tx
-	collectionBytes := collection.serialize()
+func (tx *Tx) GetCollection(name []byte) (*Collection, error) {
+	return tx.getRootCollection().GetCollection(name)
+}
 
-	rootCollection := tx.getRootCollection()
-	err := rootCollection.Put(collection.name, collectionBytes.value)
-	if err != nil {
-		return nil, err
-	}
+func (tx *Tx) CreateCollection(name []byte, options *CollectionOptions) (*Collection, error) {
+	return tx.getRootCollection().CreateCollection(name, options)
+}
 
-	return collection, nil
+func (tx *Tx) CreateCollectionIfNotExists(name []byte, options *CollectionOptions) (*Collection, error) {
+	return tx.getRootCollection().CreateCollectionIfNotExists(name, options)
 }
+
 func (tx *Tx) DeleteCollection(name []byte) error {
-	if !tx.write {
-		return writeInsideReadTxErr
-	}
+	return tx.getRootCollection().DeleteCollection(name)
+}
 
-	rootCollection := tx.getRootCollection()
+func (tx *Tx) SetCollectionMeta(name []byte, meta CollectionMeta) error {
+	return tx.getRootCollection().SetCollectionMeta(name, meta)
+}
 
-	return rootCollection.Remove(name)
+func (tx *Tx) RenameCollection(oldName, newName []byte) error {
+	return tx.getRootCollection().RenameCollection(oldName, newName)
+}
 
-}
\ No newline at end of file
+// Collections iterates over the top-level collections of the database in
+// name order.
+func (tx *Tx) Collections() iter.Seq2[*Collection, error] {
+	return tx.getRootCollection().Collections()
+}
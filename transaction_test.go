@@ -0,0 +1,101 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCollectionRootsPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDBAt(t, path, nil)
+	update(t, db, func(tx *Tx) error {
+		parent, err := tx.CreateCollection([]byte("parent"), nil)
+		if err != nil {
+			return err
+		}
+		_, err = parent.CreateCollection([]byte("child"), nil)
+		return err
+	})
+	// Enough keys to split the roots more than once, written over several
+	// transactions through handles opened in each of them.
+	for round := 0; round < 4; round++ {
+		update(t, db, func(tx *Tx) error {
+			parent, err := tx.GetCollection([]byte("parent"))
+			if err != nil {
+				return err
+			}
+			child, err := parent.GetCollection([]byte("child"))
+			if err != nil {
+				return err
+			}
+			for i := round * 2000; i < (round+1)*2000; i++ {
+				if err := parent.Put(benchKey(i), make([]byte, 50)); err != nil {
+					return err
+				}
+				if err := child.Put(benchKey(i), make([]byte, 50)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	_ = db.Close()
+
+	db = openTestDBAt(t, path, nil)
+	view(t, db, func(tx *Tx) error {
+		parent, err := tx.GetCollection([]byte("parent"))
+		if err != nil {
+			return err
+		}
+		child, err := parent.GetCollection([]byte("child"))
+		if err != nil {
+			return err
+		}
+		// parent also holds the header of child.
+		if n := len(collectionKeys(t, parent)); n != 8001 {
+			t.Errorf("parent holds %d keys, want 8001", n)
+		}
+		if n := len(collectionKeys(t, child)); n != 8000 {
+			t.Errorf("child holds %d keys, want 8000", n)
+		}
+		return nil
+	})
+}
+
+func TestRollbackDiscardsWrites(t *testing.T) {
+	db := openTestDB(t, nil)
+	fillCollection(t, db, "c", 100)
+	before := usedPages(db)
+
+	tx := db.WriteTx()
+	c, err := tx.GetCollection([]byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 100; i < 2000; i++ {
+		if err := c.Put(benchKey(i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tx.CreateCollection([]byte("d"), nil); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+
+	if used := usedPages(db); used != before {
+		t.Errorf("%d pages in use after the rollback, want %d", used, before)
+	}
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		if n := len(collectionKeys(t, c)); n != 100 {
+			t.Errorf("c holds %d keys after the rollback, want 100", n)
+		}
+		if d, err := tx.GetCollection([]byte("d")); err != nil || d != nil {
+			t.Errorf("d exists after the rollback: %v, %v", d, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// An expiring item stores the time it expires at, in Unix nanoseconds, in
+// front of its value. Each one also has an entry in the ttl collection, a
+// hidden top-level collection keyed by that time, followed by the path of
+// the collection holding the item and the item's key. The reaper walks the
+// ttl collection from the start, so it never has to scan a collection to
+// find what has expired.
+
+const expiresAtSize = 8
+
+var ttlCollectionName = []byte("\x00ttl")
+
+var invalidTTLErr = errors.New("ttl must be positive")
+
+// PutWithTTL stores the item like Put, but hides it from Find and cursors
+// once ttl has passed. The reaper deletes it for good some time after.
+func (c *Collection) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return invalidTTLErr
+	}
+
+	return c.put(expiringItem(key, value, ttl))
+}
+
+func expiringItem(key []byte, value []byte, ttl time.Duration) *Item {
+	b := make([]byte, expiresAtSize, expiresAtSize+len(value))
+	binary.LittleEndian.PutUint64(b, uint64(time.Now().Add(ttl).UnixNano()))
+	b = append(b, value...)
+	return &Item{key: key, value: b, flags: expiringItemFlag}
+}
+
+// rewrite is update for writes that only replace the value under key. fn
+// returns the new value and whether to write it. The item written expires
+// when the one it replaces does; a key that isn't there gets the default
+// TTL of c, as with Put.
+func (c *Collection) rewrite(key []byte, fn func(current *Item) ([]byte, bool, error)) (*Item, error) {
+	if !c.tx.write {
+		return nil, writeInsideReadTxErr
+	}
+	pos, err := c.locate(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.updateAt(pos, func(current *Item) (*Item, error) {
+		value, ok, err := fn(current)
+		if err != nil || !ok {
+			return nil, err
+		}
+		if current == nil {
+			return c.newItem(key, value), nil
+		}
+		if stored := pos.item(); stored.isExpiring() {
+			item := NewItem(key, append(append([]byte{}, stored.value[:expiresAtSize]...), value...))
+			item.flags = expiringItemFlag
+			return item, nil
+		}
+		return NewItem(key, value), nil
+	})
+}
+
+// plainValue is the value of i as it was put, without an expiry time.
+func (i *Item) plainValue() []byte {
+	if i.isExpiring() {
+		return i.value[expiresAtSize:]
+	}
+	return i.value
+}
+
+func (i *Item) expiresAt() time.Time {
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(i.value)))
+}
+
+// visible returns item the way callers of the collection see it: nil if it
+// is internal or has expired, and otherwise a copy without the expiry time,
+// or without any value for a blob or the header of a nested collection,
+// that is tied to the transaction of c. Plain items of a file that isn't
+// mapped stay valid after the transaction, so they are returned as they
+// are, which keeps lookups from allocating.
+func (c *Collection) visible(item *Item) *Item {
+	if item.isInternal() {
+		return nil
+	}
+	if item.flags&(expiringItemFlag|blobItemFlag|collectionItemFlag) == 0 && !c.tx.db.mmap {
+		return item
+	}
+	if item.isExpiring() && !time.Now().Before(item.expiresAt()) {
+		return nil
+	}
+	value := item.plainValue()
+	if item.isBlob() || item.isCollection() {
+		value = nil
+	}
+	return &Item{key: item.key, value: value, flags: item.flags &^ expiringItemFlag, tx: c.tx}
+}
+
+// updateExpiry keeps the ttl collection in step with c after old was
+// replaced by item. Either of them may be nil.
+func (c *Collection) updateExpiry(old *Item, item *Item) error {
+	expired := old != nil && old.isExpiring()
+	expiring := item != nil && item.isExpiring()
+	if !expired && !expiring {
+		return nil
+	}
+
+	index, err := c.tx.ttlIndex(true)
+	if err != nil {
+		return err
+	}
+	path := c.path()
+	if expired {
+		if err := index.Remove(ttlKey(old.expiresAt(), path, old.key)); err != nil {
+			return err
+		}
+	}
+	if expiring {
+		if err := index.Put(ttlKey(item.expiresAt(), path, item.key), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkExpiry fails if updateExpiry can't keep the ttl collection in step
+// after old is replaced by item, so that a write finds out before it
+// changes the tree.
+func (c *Collection) checkExpiry(old *Item, item *Item) error {
+	if (old == nil || !old.isExpiring()) && (item == nil || !item.isExpiring()) {
+		return nil
+	}
+	_, err := c.tx.ttlIndex(false)
+	return err
+}
+
+func (tx *Tx) ttlIndex(create bool) (*Collection, error) {
+	return tx.getRootCollection().internalCollection(ttlCollectionName, create)
+}
+
+// collectionAt opens the collection found by following path from the root
+// catalog, or returns nil if any part of it is missing.
+func (tx *Tx) collectionAt(path [][]byte) (*Collection, error) {
+	collection := tx.getRootCollection()
+	for _, name := range path {
+		var err error
+		collection, err = collection.GetCollection(name)
+		if err != nil || collection == nil {
+			return nil, err
+		}
+	}
+	return collection, nil
+}
+
+// renameExpiring moves the ttl entries of the collections under oldPath to
+// newPath after a rename.
+func (tx *Tx) renameExpiring(oldPath, newPath [][]byte) error {
+	index, err := tx.ttlIndex(false)
+	if err != nil || index == nil {
+		return err
+	}
+
+	var entries [][]byte
+	cursor := index.Cursor()
+	item, err := cursor.First()
+	for ; item != nil; item, err = cursor.Next() {
+		if _, path, _ := parseTTLKey(item.key); hasPathPrefix(path, oldPath) {
+			entries = append(entries, item.key)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		expiresAt, path, key := parseTTLKey(entry)
+		path = movePath(path, oldPath, newPath)
+		if err := index.Remove(entry); err != nil {
+			return err
+		}
+		if err := index.Put(ttlKey(expiresAt, path, key), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reapExpired deletes up to limit expired items in a single write
+// transaction and returns how many ttl entries it went through.
+func (db *DB) reapExpired(limit int) (int, error) {
+	tx := db.WriteTx()
+	index, err := tx.ttlIndex(false)
+	if err != nil || index == nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	now := time.Now()
+	var entries [][]byte
+	cursor := index.Cursor()
+	item, err := cursor.First()
+	for ; item != nil && len(entries) < limit; item, err = cursor.Next() {
+		if expiresAt, _, _ := parseTTLKey(item.key); expiresAt.After(now) {
+			break
+		}
+		entries = append(entries, item.key)
+	}
+	// Committing would write the freelist even with nothing to reap.
+	if err != nil || len(entries) == 0 {
+		tx.Rollback()
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		if err := tx.expire(index, entry); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	return len(entries), tx.Commit()
+}
+
+// expire deletes the item a ttl entry points to, as long as it is still the
+// same expiring item, and then the entry itself.
+func (tx *Tx) expire(index *Collection, entry []byte) error {
+	expiresAt, path, key := parseTTLKey(entry)
+	collection, err := tx.collectionAt(path)
+	if err != nil {
+		return err
+	}
+	if collection != nil {
+		item, err := collection.find(key)
+		if err != nil {
+			return err
+		}
+		if item != nil && item.isExpiring() && item.expiresAt().Equal(expiresAt) {
+			return collection.Remove(key)
+		}
+	}
+	return index.Remove(entry)
+}
+
+func (db *DB) startReaper(interval time.Duration, batchSize int) {
+	if batchSize <= 0 {
+		batchSize = DefaultOptions.ReapBatchSize
+	}
+	db.stopReaper = make(chan struct{})
+	db.reaperDone = make(chan struct{})
+
+	go func() {
+		defer close(db.reaperDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-db.stopReaper:
+				return
+			case <-ticker.C:
+			}
+
+			for {
+				reaped, err := db.reapExpired(batchSize)
+				if err != nil || reaped < batchSize {
+					break
+				}
+				select {
+				case <-db.stopReaper:
+					return
+				default:
+				}
+			}
+		}
+	}()
+}
+
+func (db *DB) stopReaping() {
+	if db.stopReaper == nil {
+		return
+	}
+	close(db.stopReaper)
+	<-db.reaperDone
+	db.stopReaper = nil
+}
+
+func ttlKey(expiresAt time.Time, path [][]byte, key []byte) []byte {
+	b := binary.BigEndian.AppendUint64(nil, uint64(expiresAt.UnixNano()))
+	b = appendPath(b, path)
+	return append(b, key...)
+}
+
+func parseTTLKey(b []byte) (time.Time, [][]byte, []byte) {
+	expiresAt := time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	path, key := readPath(b[8:])
+	return expiresAt, path, key
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// ttlEntries counts the entries of the ttl collection.
+func ttlEntries(tb testing.TB, tx *Tx) int {
+	tb.Helper()
+	index, err := tx.ttlIndex(false)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if index == nil {
+		return 0
+	}
+	return len(collectionKeys(tb, index))
+}
+
+func TestPutWithTTL(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), nil)
+		if err != nil {
+			return err
+		}
+		if err := c.PutWithTTL([]byte("short"), []byte("value"), 20*time.Millisecond); err != nil {
+			return err
+		}
+		if err := c.PutWithTTL([]byte("long"), []byte("value"), time.Hour); err != nil {
+			return err
+		}
+		if err := c.PutWithTTL([]byte("kept"), []byte("value"), 20*time.Millisecond); err != nil {
+			return err
+		}
+		// Putting without a TTL makes the key permanent again.
+		if err := c.Put([]byte("kept"), []byte("value")); err != nil {
+			return err
+		}
+		if err := c.PutWithTTL([]byte("bad"), []byte("value"), 0); err != invalidTTLErr {
+			t.Errorf("PutWithTTL with no ttl returned %v, want %v", err, invalidTTLErr)
+		}
+		if item, err := c.Find([]byte("short")); err != nil || item == nil || string(item.Value()) != "value" {
+			t.Errorf("Find returned %v, %v before the item expired", item, err)
+		}
+		return nil
+	})
+	time.Sleep(30 * time.Millisecond)
+
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		if item, err := c.Find([]byte("short")); err != nil || item != nil {
+			t.Errorf("Find returned %v, %v for an expired item", item, err)
+		}
+		if keys := collectionKeys(t, c); len(keys) != 2 {
+			t.Errorf("cursor returned %v, want long and kept", keys)
+		}
+		if n := ttlEntries(t, tx); n != 2 {
+			t.Errorf("%d ttl entries, want 2", n)
+		}
+		return nil
+	})
+
+	if _, err := db.reapExpired(100); err != nil {
+		t.Fatal(err)
+	}
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		if item, err := c.find([]byte("short")); err != nil || item != nil {
+			t.Errorf("the expired item is still stored after reaping: %v, %v", item, err)
+		}
+		if n := ttlEntries(t, tx); n != 1 {
+			t.Errorf("%d ttl entries after reaping, want 1", n)
+		}
+		return nil
+	})
+}
+
+func TestReapingNothingWritesNothing(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), nil)
+		if err != nil {
+			return err
+		}
+		return c.PutWithTTL([]byte("key"), []byte("value"), time.Hour)
+	})
+
+	// A commit would write the freelist page over the marker.
+	marker := int64(db.freeListPage+1)*int64(db.pageSize) - 1
+	if _, err := db.file.WriteAt([]byte{0xaa}, marker); err != nil {
+		t.Fatal(err)
+	}
+	if reaped, err := db.reapExpired(100); err != nil || reaped != 0 {
+		t.Fatalf("reapExpired returned %d, %v", reaped, err)
+	}
+	b := make([]byte, 1)
+	if _, err := db.file.ReadAt(b, marker); err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != 0xaa {
+		t.Error("reaping nothing wrote the freelist")
+	}
+}
+
+func TestCollectionTTL(t *testing.T) {
+	db := openTestDB(t, func(options *Options) {
+		options.ReapInterval = 5 * time.Millisecond
+	})
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), &CollectionOptions{TTL: 10 * time.Millisecond})
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 300; i++ {
+			if err := c.Put(benchKey(i), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tx := db.ReadTx()
+		left := ttlEntries(t, tx)
+		tx.Rollback()
+		if left == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d ttl entries left, the reaper didn't delete them", left)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		if item, err := c.find(benchKey(0)); err != nil || item != nil {
+			t.Errorf("the reaper left %v, %v", item, err)
+		}
+		return nil
+	})
+}
+
+func TestTTLFollowsRename(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("a"), nil)
+		if err != nil {
+			return err
+		}
+		if err := c.PutWithTTL([]byte("key"), []byte("value"), 10*time.Millisecond); err != nil {
+			return err
+		}
+		return tx.RenameCollection([]byte("a"), []byte("b"))
+	})
+	time.Sleep(20 * time.Millisecond)
+	if _, err := db.reapExpired(100); err != nil {
+		t.Fatal(err)
+	}
+
+	view(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("b"))
+		if err != nil {
+			return err
+		}
+		if item, err := c.find([]byte("key")); err != nil || item != nil {
+			t.Errorf("the item wasn't reaped after the rename: %v, %v", item, err)
+		}
+		return nil
+	})
+}
+
+func TestTTLNameIsReserved(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		if _, err := tx.CreateCollection(ttlCollectionName, nil); err != reservedNameErr {
+			t.Errorf("creating the ttl collection returned %v", err)
+		}
+		c, err := tx.CreateCollection([]byte("c"), nil)
+		if err != nil {
+			return err
+		}
+		if err := tx.RenameCollection([]byte("c"), ttlCollectionName); err != reservedNameErr {
+			t.Errorf("renaming to the ttl collection returned %v", err)
+		}
+		// The name is only taken in the root catalog.
+		if _, err := c.CreateCollection(ttlCollectionName, nil); err != nil {
+			return err
+		}
+		return c.PutWithTTL([]byte("key"), []byte("value"), time.Hour)
+	})
+
+	db = openTestDB(t, nil)
+	tx := db.WriteTx()
+	defer tx.Rollback()
+	c, err := tx.CreateCollection([]byte("c"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putUnchecked(t, tx.getRootCollection(), ttlCollectionName, []byte("value"))
+	if err := c.PutWithTTL([]byte("key"), []byte("value"), time.Hour); err != reservedNameErr {
+		t.Errorf("PutWithTTL with the ttl name taken returned %v", err)
+	}
+	if item, err := c.find([]byte("key")); err != nil || item != nil {
+		t.Errorf("the failed PutWithTTL left %v, %v", item, err)
+	}
+}
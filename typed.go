@@ -0,0 +1,123 @@
+package main
+
+import "iter"
+
+// TypedCollection stores keys of type K and values of type V in a
+// Collection, converting them with a pair of codecs.
+type TypedCollection[K, V any] struct {
+	collection *Collection
+	keys       Codec[K]
+	values     Codec[V]
+}
+
+// Entry is a key and value read from a TypedCollection.
+type Entry[K, V any] struct {
+	Key   K
+	Value V
+}
+
+func NewTypedCollection[K, V any](collection *Collection, keys Codec[K], values Codec[V]) *TypedCollection[K, V] {
+	return &TypedCollection[K, V]{collection, keys, values}
+}
+
+func (t *TypedCollection[K, V]) Collection() *Collection {
+	return t.collection
+}
+
+// Get returns the value stored under key and whether there was one.
+func (t *TypedCollection[K, V]) Get(key K) (V, bool, error) {
+	var value V
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return value, false, err
+	}
+	item, err := t.collection.Find(k)
+	if err != nil || item == nil {
+		return value, false, err
+	}
+	value, err = t.values.Decode(item.value)
+	return value, err == nil, err
+}
+
+func (t *TypedCollection[K, V]) Put(key K, value V) error {
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+	v, err := t.values.Encode(value)
+	if err != nil {
+		return err
+	}
+	return t.collection.Put(k, v)
+}
+
+func (t *TypedCollection[K, V]) Remove(key K) error {
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+	return t.collection.Remove(k)
+}
+
+// All iterates over every entry in key order.
+func (t *TypedCollection[K, V]) All() iter.Seq2[Entry[K, V], error] {
+	return t.scan(nil, nil)
+}
+
+// Range iterates over the entries with start <= key < end, in key order.
+func (t *TypedCollection[K, V]) Range(start, end K) iter.Seq2[Entry[K, V], error] {
+	return func(yield func(Entry[K, V], error) bool) {
+		from, err := t.keys.Encode(start)
+		if err != nil {
+			yield(Entry[K, V]{}, err)
+			return
+		}
+		to, err := t.keys.Encode(end)
+		if err != nil {
+			yield(Entry[K, V]{}, err)
+			return
+		}
+		t.scan(from, to)(yield)
+	}
+}
+
+func (t *TypedCollection[K, V]) scan(start, end []byte) iter.Seq2[Entry[K, V], error] {
+	return func(yield func(Entry[K, V], error) bool) {
+		cursor := t.collection.Cursor()
+		// A nil start isn't the smallest key under every comparator.
+		var item *Item
+		var err error
+		if start == nil {
+			item, err = cursor.First()
+		} else {
+			item, err = cursor.Seek(start)
+		}
+		for ; item != nil; item, err = cursor.Next() {
+			if end != nil && t.collection.compare(item.key, end) >= 0 {
+				return
+			}
+			if item.isCollection() {
+				continue
+			}
+			entry, err := t.decode(item)
+			if !yield(entry, err) || err != nil {
+				return
+			}
+		}
+		if err != nil {
+			yield(Entry[K, V]{}, err)
+		}
+	}
+}
+
+func (t *TypedCollection[K, V]) decode(item *Item) (Entry[K, V], error) {
+	key, err := t.keys.Decode(item.key)
+	if err != nil {
+		return Entry[K, V]{}, err
+	}
+	value, err := t.values.Decode(item.value)
+	if err != nil {
+		return Entry[K, V]{}, err
+	}
+	return Entry[K, V]{key, value}, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"iter"
+	"testing"
+)
+
+type account struct {
+	Owner   string
+	Balance int
+}
+
+func typedEntries[K, V any](tb testing.TB, entries iter.Seq2[Entry[K, V], error]) []string {
+	tb.Helper()
+	var got []string
+	for entry, err := range entries {
+		if err != nil {
+			tb.Fatal(err)
+		}
+		got = append(got, fmt.Sprint(entry.Key, "=", entry.Value))
+	}
+	return got
+}
+
+func TestTypedCollection(t *testing.T) {
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("accounts"), nil)
+		if err != nil {
+			return err
+		}
+		accounts := NewTypedCollection(c, Int64Codec{}, JSONCodec[account]{})
+		for _, id := range []int64{3, -2, 10, 0} {
+			if err := accounts.Put(id, account{fmt.Sprint("owner", id), int(id) * 10}); err != nil {
+				return err
+			}
+		}
+
+		value, ok, err := accounts.Get(10)
+		if err != nil || !ok || value != (account{"owner10", 100}) {
+			t.Errorf("Get returned %+v, %v, %v", value, ok, err)
+		}
+		if _, ok, err := accounts.Get(11); err != nil || ok {
+			t.Errorf("Get of a missing key returned %v, %v", ok, err)
+		}
+		if err := accounts.Remove(0); err != nil {
+			return err
+		}
+
+		// Keys come out in numeric order, negative ones first.
+		if got := typedEntries(t, accounts.All()); fmt.Sprint(got) != "[-2={owner-2 -20} 3={owner3 30} 10={owner10 100}]" {
+			t.Errorf("All returned %v", got)
+		}
+		if got := typedEntries(t, accounts.Range(-2, 10)); fmt.Sprint(got) != "[-2={owner-2 -20} 3={owner3 30}]" {
+			t.Errorf("Range returned %v", got)
+		}
+		return nil
+	})
+}
+
+func TestTypedCollectionWithComparator(t *testing.T) {
+	RegisterComparator("test-typed-reverse", reverseCompare)
+	db := openTestDB(t, nil)
+	update(t, db, func(tx *Tx) error {
+		c, err := tx.CreateCollection([]byte("c"), &CollectionOptions{Comparator: "test-typed-reverse"})
+		if err != nil {
+			return err
+		}
+		typed := NewTypedCollection(c, StringCodec{}, StringCodec{})
+		for _, key := range []string{"a", "b", "c"} {
+			if err := typed.Put(key, key); err != nil {
+				return err
+			}
+		}
+		if got := typedEntries(t, typed.All()); fmt.Sprint(got) != "[c=c b=b a=a]" {
+			t.Errorf("All returned %v, want [c=c b=b a=a]", got)
+		}
+		if got := typedEntries(t, typed.Range("c", "a")); fmt.Sprint(got) != "[c=c b=b]" {
+			t.Errorf("Range returned %v, want [c=c b=b]", got)
+		}
+		return nil
+	})
+}